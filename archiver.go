@@ -0,0 +1,32 @@
+package tgz
+
+import (
+	"archive/tar"
+	"io"
+	"sync"
+)
+
+// Archiver reuses gzip writers across archives through a sync.Pool to cut
+// the allocations of creating a new compressor for every Tar call. The zero
+// value is ready to use and an Archiver is safe for concurrent use.
+type Archiver struct {
+	Options *TarOptions // extended settings applied to every archive
+	pool    sync.Pool
+}
+
+// Tar is the same as the package level Tar using a pooled gzip writer
+func (a *Archiver) Tar(src string, opt *tar.Header, writers ...io.Writer) error {
+
+	// the output layers over a writer that duplicates its writes
+	w, finish, err := a.Options.layers(io.MultiWriter(writers...), &a.pool, src)
+	if err != nil {
+		return err
+	}
+
+	err = tarTo(w, opt, a.Options, src)
+	if ferr := finish(); err == nil {
+		err = ferr
+	}
+
+	return err
+}
@@ -0,0 +1,43 @@
+package tgz
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// paxBirthTime is the PAX record used by libarchive for the creation time
+const paxBirthTime = "LIBARCHIVE.creationtime"
+
+// formatPAXTime formats t as the decimal seconds used in PAX time records
+func formatPAXTime(t time.Time) string {
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+// parsePAXTime parses the decimal seconds used in PAX time records
+func parsePAXTime(s string) (time.Time, error) {
+
+	secs, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		secs, frac = s[:i], s[i+1:]
+	}
+
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var nsec int64
+	if frac != "" {
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		frac += strings.Repeat("0", 9-len(frac))
+		if nsec, err = strconv.ParseInt(frac, 10, 64); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return time.Unix(sec, nsec), nil
+}
@@ -0,0 +1,23 @@
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package tgz
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// birthTime returns the creation time recorded by the filesystem
+func birthTime(info os.FileInfo) (time.Time, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(st.Birthtimespec.Unix()), true
+}
+
+// setBirthTime is a no-op; the creation time can not be set through the
+// syscall package on this platform
+func setBirthTime(file string, t time.Time) error { return nil }
@@ -0,0 +1,15 @@
+//go:build !darwin && !freebsd && !netbsd && !windows
+// +build !darwin,!freebsd,!netbsd,!windows
+
+package tgz
+
+import (
+	"os"
+	"time"
+)
+
+// birthTime is not available through the syscall package on this platform
+func birthTime(info os.FileInfo) (time.Time, bool) { return time.Time{}, false }
+
+// setBirthTime is a no-op where the creation time can not be set
+func setBirthTime(file string, t time.Time) error { return nil }
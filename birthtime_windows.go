@@ -0,0 +1,35 @@
+package tgz
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// birthTime returns the creation time recorded by the filesystem
+func birthTime(info os.FileInfo) (time.Time, bool) {
+	attr, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, attr.CreationTime.Nanoseconds()), true
+}
+
+// setBirthTime sets the creation time of file
+func setBirthTime(file string, t time.Time) error {
+
+	name, err := syscall.UTF16PtrFromString(file)
+	if err != nil {
+		return err
+	}
+
+	h, err := syscall.CreateFile(name, syscall.FILE_WRITE_ATTRIBUTES, syscall.FILE_SHARE_WRITE,
+		nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(h)
+
+	ft := syscall.NsecToFiletime(t.UnixNano())
+	return syscall.SetFileTime(h, &ft, nil, nil)
+}
@@ -0,0 +1,55 @@
+package tgz
+
+import "io"
+
+// blockWriter hands the output to w in records of exactly size bytes, the
+// last one padded with zeros, for devices such as tape drives that need a
+// fixed record size
+type blockWriter struct {
+	w    io.Writer // destination
+	buf  []byte    // current record
+	size int       // record size
+}
+
+func newBlockWriter(w io.Writer, size int) *blockWriter {
+	return &blockWriter{w: w, buf: make([]byte, 0, size), size: size}
+}
+
+func (bw *blockWriter) Write(p []byte) (int, error) {
+
+	var total int
+	for len(p) > 0 {
+		n := copy(bw.buf[len(bw.buf):bw.size], p)
+		bw.buf = bw.buf[:len(bw.buf)+n]
+		total += n
+		p = p[n:]
+
+		// emit each full record
+		if len(bw.buf) == bw.size {
+			if _, err := bw.w.Write(bw.buf); err != nil {
+				return total, err
+			}
+			bw.buf = bw.buf[:0]
+		}
+	}
+
+	return total, nil
+}
+
+// Close pads and writes the final partial record; the underlying writer is
+// not closed
+func (bw *blockWriter) Close() error {
+
+	if len(bw.buf) == 0 {
+		return nil
+	}
+
+	pad := bw.buf[len(bw.buf):bw.size]
+	for i := range pad {
+		pad[i] = 0
+	}
+	_, err := bw.w.Write(bw.buf[:bw.size])
+	bw.buf = bw.buf[:0]
+
+	return err
+}
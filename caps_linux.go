@@ -0,0 +1,33 @@
+package tgz
+
+import "syscall"
+
+// paxCaps is the PAX record used by GNU and BSD tar for the file
+// capability extended attribute
+const paxCaps = "SCHILY.xattr.security.capability"
+
+// getCaps returns the security.capability xattr of file, or nil when the
+// file carries no capabilities
+func getCaps(file string) ([]byte, error) {
+
+	sz, err := syscall.Getxattr(file, "security.capability", nil)
+	switch {
+	case err == syscall.ENODATA || err == syscall.ENOTSUP:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	b := make([]byte, sz)
+	sz, err = syscall.Getxattr(file, "security.capability", b)
+	if err != nil {
+		return nil, err
+	}
+
+	return b[:sz], nil
+}
+
+// setCaps restores the security.capability xattr on file
+func setCaps(file string, b []byte) error {
+	return syscall.Setxattr(file, "security.capability", b, 0)
+}
@@ -0,0 +1,58 @@
+package tgz_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/zxdez/tgz"
+)
+
+func TestPreserveCaps(t *testing.T) {
+
+	// vfs_cap_data revision 2 granting cap_net_bind_service
+	caps := make([]byte, 20)
+	binary.LittleEndian.PutUint32(caps[0:], 0x02000000)
+	binary.LittleEndian.PutUint32(caps[4:], 1<<10)
+
+	src := t.TempDir()
+	file := filepath.Join(src, "server")
+	ioutil.WriteFile(file, []byte("binary"), 0755)
+	if err := syscall.Setxattr(file, "security.capability", caps, 0); err != nil {
+		t.Skip("setting file capabilities is not permitted:", err)
+	}
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{PreserveCaps: true}, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// the archive carries the xattr the way GNU tar records it
+	gzr, _ := gzip.NewReader(bytes.NewReader(b.Bytes()))
+	header, err := tar.NewReader(gzr).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.PAXRecords["SCHILY.xattr.security.capability"] != string(caps) {
+		t.Fatalf("capability PAX record missing: %q", header.PAXRecords)
+	}
+
+	dst := t.TempDir()
+	if err := tgz.UntarWith(dst, b, &tgz.UntarOptions{PreserveCaps: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, 64)
+	n, err := syscall.Getxattr(filepath.Join(dst, "server"), "security.capability", got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:n], caps) {
+		t.Fatalf("capabilities not restored: %x", got[:n])
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package tgz
+
+// paxCaps is the PAX record used by GNU and BSD tar for the file
+// capability extended attribute
+const paxCaps = "SCHILY.xattr.security.capability"
+
+// getCaps is a no-op where file capabilities are not supported
+func getCaps(file string) ([]byte, error) { return nil, nil }
+
+// setCaps is a no-op where file capabilities are not supported
+func setCaps(file string, b []byte) error { return nil }
@@ -0,0 +1,52 @@
+package tgz_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/zxdez/tgz"
+)
+
+func TestUntarMapOwner(t *testing.T) {
+
+	if os.Geteuid() != 0 {
+		t.Skip("changing owners needs root")
+	}
+
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 1000, Gid: 1000})
+	tw.WriteHeader(&tar.Header{Name: "dir/a.txt", Mode: 0644, Size: 1, Uid: 1000, Gid: 1000})
+	tw.Write([]byte("a"))
+	tw.WriteHeader(&tar.Header{Name: "dir/b.txt", Mode: 0644, Size: 1, Uid: 2000, Gid: 2000})
+	tw.Write([]byte("b"))
+	tw.Close()
+
+	// 1000 becomes 1500, any other owner is kept as recorded
+	remap := func(uid, gid int) (int, int) {
+		if uid == 1000 {
+			return 1500, 1500
+		}
+		return uid, gid
+	}
+
+	dst := t.TempDir()
+	if err := tgz.UntarWith(dst, b, &tgz.UntarOptions{MapOwner: remap}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]uint32{"dir": 1500, "dir/a.txt": 1500, "dir/b.txt": 2000} {
+		info, err := os.Lstat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		if st.Uid != want || st.Gid != want {
+			t.Fatalf("%s: owned by %d:%d, want %d", name, st.Uid, st.Gid, want)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package tgz
+
+import "os"
+
+// lchown sets the owner of target without following a symlink
+func lchown(target string, uid, gid int) error { return os.Lchown(target, uid, gid) }
@@ -0,0 +1,4 @@
+package tgz
+
+// lchown is a no-op; Windows has no numeric owners
+func lchown(target string, uid, gid int) error { return nil }
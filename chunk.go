@@ -0,0 +1,151 @@
+package tgz
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// paxParts marks the index entry of a file split by ChunkSize, holding the
+// number of parts that follow it
+const paxParts = "TGZ.parts"
+
+// partsIndex is the body of the index entry written ahead of the parts of a
+// chunked file, enough to reassemble it with or without this package
+type partsIndex struct {
+	Name  string   `json:"name"`
+	Size  int64    `json:"size"`
+	Parts []string `json:"parts"`
+}
+
+// writeChunks writes file as an index entry named <name>.parts followed by
+// parts of at most size bytes named <name>.part0001 and so on; every entry
+// carries the attributes of header
+func writeChunks(tw *tar.Writer, header *tar.Header, file string, size int64) error {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	index := partsIndex{Name: header.Name, Size: header.Size}
+	for i := int64(0); i*size < header.Size; i++ {
+		index.Parts = append(index.Parts, fmt.Sprintf("%s.part%04d", header.Name, i+1))
+	}
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	meta := *header
+	meta.Name = header.Name + ".parts"
+	meta.Size = int64(len(b))
+	meta.PAXRecords = map[string]string{paxParts: strconv.Itoa(len(index.Parts))}
+	for k, v := range header.PAXRecords {
+		meta.PAXRecords[k] = v
+	}
+	if err := tw.WriteHeader(&meta); err != nil {
+		return err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return err
+	}
+
+	remain := header.Size
+	for i, name := range index.Parts {
+		part := *header
+		part.Name = name
+		part.Size = size
+		if remain < size {
+			part.Size = remain
+		}
+		part.PAXRecords = nil
+		if err := tw.WriteHeader(&part); err != nil {
+			return err
+		}
+
+		// only the last part can tell that the file grew
+		if i == len(index.Parts)-1 {
+			return copyBody(tw, f, file, part.Size)
+		}
+		if n, err := io.CopyN(tw, f, part.Size); err == io.EOF {
+			return fmt.Errorf("%w: %s: shrank to %d of %d bytes", ErrChanged, file, header.Size-remain+n, header.Size)
+		} else if err != nil {
+			return err
+		}
+		remain -= part.Size
+	}
+
+	return nil
+}
+
+// reassemble reads the index entry in meta and returns the header of the
+// original file with a reader over the parts that follow it in tr
+func reassemble(meta *tar.Header, tr *tar.Reader) (*tar.Header, io.Reader, error) {
+
+	var index partsIndex
+	b, err := ioutil.ReadAll(io.LimitReader(tr, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, nil, fmt.Errorf("tgz: parts index %q: %w", meta.Name, err)
+	}
+
+	header := *meta
+	header.Name = index.Name
+	header.Size = index.Size
+	header.PAXRecords = make(map[string]string)
+	for k, v := range meta.PAXRecords {
+		if k != paxParts {
+			header.PAXRecords[k] = v
+		}
+	}
+
+	return &header, &partsReader{tr: tr, parts: index.Parts}, nil
+}
+
+// partsReader reads the bodies of the listed part entries in turn
+type partsReader struct {
+	tr    *tar.Reader
+	parts []string // parts not yet opened
+	open  bool     // reading the body of a part
+}
+
+func (pr *partsReader) Read(p []byte) (int, error) {
+
+	for {
+		if pr.open {
+			n, err := pr.tr.Read(p)
+			if err == io.EOF {
+				pr.open = false
+				if n == 0 {
+					continue
+				}
+				err = nil
+			}
+			return n, err
+		}
+
+		if len(pr.parts) == 0 {
+			return 0, io.EOF
+		}
+
+		header, err := pr.tr.Next()
+		if err == io.EOF {
+			return 0, fmt.Errorf("tgz: missing part %q", pr.parts[0])
+		}
+		if err != nil {
+			return 0, err
+		}
+		if header.Name != pr.parts[0] {
+			return 0, fmt.Errorf("tgz: expected part %q, found %q", pr.parts[0], header.Name)
+		}
+		pr.parts, pr.open = pr.parts[1:], true
+	}
+}
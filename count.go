@@ -0,0 +1,24 @@
+package tgz
+
+import "io"
+
+// CountingWriter counts the bytes written through it. Pass it as one of the
+// writers to Tar or Bytes to learn the compressed size of the archive, which
+// differs from the uncompressed count returned by Bytes. W may be nil to only
+// count.
+type CountingWriter struct {
+	W io.Writer // destination, or nil to discard
+	N int64     // bytes written
+}
+
+func (cw *CountingWriter) Write(p []byte) (int, error) {
+
+	n := len(p)
+	var err error
+	if cw.W != nil {
+		n, err = cw.W.Write(p)
+	}
+	cw.N += int64(n)
+
+	return n, err
+}
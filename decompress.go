@@ -0,0 +1,101 @@
+package tgz
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// decompressor opens the streams that start with magic
+type decompressor struct {
+	magic   []byte
+	factory func(io.Reader) (io.ReadCloser, error)
+}
+
+// decompressors are the registered formats, gzip and bzip2 built in
+var decompressors = struct {
+	sync.RWMutex
+	list []decompressor
+}{list: builtinDecompressors()}
+
+// builtinDecompressors returns the gzip and bzip2 formats of the standard
+// library
+func builtinDecompressors() []decompressor {
+
+	list := []decompressor{
+		{[]byte{0x1f, 0x8b}, func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		}},
+	}
+
+	// bzip2 by its whole stream header of BZh, the block size, and the
+	// block magic, as a plain tar starts with a name such as BZhello.txt
+	for level := byte('1'); level <= '9'; level++ {
+		magic := []byte{'B', 'Z', 'h', level, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59}
+		list = append(list, decompressor{magic, func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bzip2.NewReader(r)), nil
+		}})
+	}
+
+	return list
+}
+
+// RegisterDecompressor makes Untar, Walk, and everything built on them read
+// an archive whose stream starts with the magic bytes through the reader
+// returned by factory, such as an xz reader from a third-party package.
+// Gzip and bzip2 are built in; zstd, which is not in the standard library,
+// must be registered by the caller, by the magic 28 b5 2f fd. Registering
+// the same magic again replaces the earlier factory.
+func RegisterDecompressor(magic []byte, factory func(io.Reader) (io.ReadCloser, error)) {
+
+	decompressors.Lock()
+	defer decompressors.Unlock()
+
+	d := decompressor{append([]byte(nil), magic...), factory}
+	for i := range decompressors.list {
+		if bytes.Equal(decompressors.list[i].magic, magic) {
+			decompressors.list[i] = d
+			return
+		}
+	}
+	decompressors.list = append(decompressors.list, d)
+}
+
+// magicLen is the number of bytes to read to match every registered magic
+func magicLen() int {
+
+	decompressors.RLock()
+	defer decompressors.RUnlock()
+
+	var n int
+	for _, d := range decompressors.list {
+		if len(d.magic) > n {
+			n = len(d.magic)
+		}
+	}
+
+	return n
+}
+
+// lookupDecompressor returns the factory with the longest magic leading
+// head, or nil for a plain tar
+func lookupDecompressor(head []byte) func(io.Reader) (io.ReadCloser, error) {
+
+	decompressors.RLock()
+	defer decompressors.RUnlock()
+
+	var match *decompressor
+	for i, d := range decompressors.list {
+		if bytes.HasPrefix(head, d.magic) && (match == nil || len(d.magic) > len(match.magic)) {
+			match = &decompressors.list[i]
+		}
+	}
+	if match == nil {
+		return nil
+	}
+
+	return match.factory
+}
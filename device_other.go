@@ -0,0 +1,12 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !illumos && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!illumos,!linux,!netbsd,!openbsd,!solaris
+
+package tgz
+
+import "os"
+
+// device is not reported where there is no stat device id
+func device(info os.FileInfo) (uint64, bool) { return 0, false }
+
+// inode is not reported where there is no stat inode
+func inode(info os.FileInfo) (inodeKey, uint64, bool) { return inodeKey{}, 0, false }
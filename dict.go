@@ -0,0 +1,164 @@
+package tgz
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+)
+
+// ErrDictionary is returned by the NewDictReader stream when the archive was
+// compressed with a different preset dictionary
+var ErrDictionary = errors.New("tgz: gzip dictionary does not match")
+
+// dictID is the gzip extra subfield id holding the adler32 of the dictionary
+var dictID = [2]byte{'T', 'D'}
+
+// dictWriter writes a single member gzip stream deflated against a preset
+// dictionary, which the gzip format itself has no field for
+type dictWriter struct {
+	w    io.Writer
+	fw   *flate.Writer
+	crc  hash.Hash32
+	size uint32
+}
+
+func newDictWriter(w io.Writer, dict []byte) (*dictWriter, error) {
+
+	// gzip header with the dictionary id in an extra field
+	header := []byte{0x1f, 0x8b, 8, 1 << 2, 0, 0, 0, 0, 0, 255, 8, 0, dictID[0], dictID[1], 4, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(header[16:], adler32.Checksum(dict))
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	fw, err := flate.NewWriterDict(w, flate.DefaultCompression, dict)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dictWriter{w: w, fw: fw, crc: crc32.NewIEEE()}, nil
+}
+
+func (dw *dictWriter) Write(p []byte) (int, error) {
+	n, err := dw.fw.Write(p)
+	dw.crc.Write(p[:n])
+	dw.size += uint32(n)
+	return n, err
+}
+
+// Close flushes the deflate stream and writes the gzip trailer; the
+// underlying io.Writer is not closed
+func (dw *dictWriter) Close() error {
+
+	if err := dw.fw.Close(); err != nil {
+		return err
+	}
+
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], dw.crc.Sum32())
+	binary.LittleEndian.PutUint32(trailer[4:], dw.size)
+	_, err := dw.w.Write(trailer[:])
+
+	return err
+}
+
+// NewDictReader returns the decompressed stream of an archive written with
+// TarOptions.Dictionary, to pass on to Untar, Walk, or List as a plain tar;
+// dict must be the bytes the archive was written with. The standard gzip
+// readers can not decompress such an archive.
+func NewDictReader(r io.Reader, dict []byte) (io.ReadCloser, error) {
+
+	br := bufio.NewReader(r)
+
+	var header [10]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 0x1f || header[1] != 0x8b || header[2] != 8 {
+		return nil, gzip.ErrHeader
+	}
+	flags := header[3]
+
+	// check the dictionary id when the writer recorded one
+	if flags&(1<<2) != 0 {
+		var xlen [2]byte
+		if _, err := io.ReadFull(br, xlen[:]); err != nil {
+			return nil, err
+		}
+		extra := make([]byte, binary.LittleEndian.Uint16(xlen[:]))
+		if _, err := io.ReadFull(br, extra); err != nil {
+			return nil, err
+		}
+		for len(extra) >= 4 {
+			n := int(binary.LittleEndian.Uint16(extra[2:4]))
+			if 4+n > len(extra) {
+				return nil, gzip.ErrHeader
+			}
+			if extra[0] == dictID[0] && extra[1] == dictID[1] && n == 4 &&
+				binary.LittleEndian.Uint32(extra[4:8]) != adler32.Checksum(dict) {
+				return nil, ErrDictionary
+			}
+			extra = extra[4+n:]
+		}
+	}
+
+	// skip the name and comment, then the header crc
+	for _, flag := range []byte{1 << 3, 1 << 4} {
+		if flags&flag != 0 {
+			if _, err := br.ReadBytes(0); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if flags&(1<<1) != 0 {
+		if _, err := br.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+
+	return &dictReader{br: br, fr: flate.NewReaderDict(br, dict), crc: crc32.NewIEEE()}, nil
+}
+
+// dictReader inflates a dictWriter stream and verifies its trailer
+type dictReader struct {
+	br   *bufio.Reader
+	fr   io.ReadCloser
+	crc  hash.Hash32
+	size uint32
+	err  error // latched once the trailer was read
+}
+
+func (dr *dictReader) Read(p []byte) (int, error) {
+
+	if dr.err != nil {
+		return 0, dr.err
+	}
+
+	n, err := dr.fr.Read(p)
+	dr.crc.Write(p[:n])
+	dr.size += uint32(n)
+	if err != io.EOF {
+		return n, err
+	}
+
+	var trailer [8]byte
+	switch _, err := io.ReadFull(dr.br, trailer[:]); {
+	case err != nil:
+		dr.err = io.ErrUnexpectedEOF
+	case binary.LittleEndian.Uint32(trailer[:4]) != dr.crc.Sum32() ||
+		binary.LittleEndian.Uint32(trailer[4:]) != dr.size:
+		dr.err = gzip.ErrChecksum
+	default:
+		dr.err = io.EOF
+	}
+
+	return n, dr.err
+}
+
+func (dr *dictReader) Close() error { return dr.fr.Close() }
@@ -0,0 +1,125 @@
+package tgz
+
+import (
+	"archive/tar"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// TarDigests takes a source path and writes the archive to w the same as Tar
+// while computing the md5 and sha256 digests of the archive in the same pass
+func TarDigests(src string, opt *tar.Header, w io.Writer) (md5sum, sha256sum []byte, err error) {
+
+	m, s := md5.New(), sha256.New()
+	if err := Tar(src, opt, w, m, s); err != nil {
+		return nil, nil, err
+	}
+
+	return m.Sum(nil), s.Sum(nil), nil
+}
+
+// TarDigest takes a source path and writes the archive to w the same as Tar,
+// returning the sha256 digest and the size of the compressed archive
+func TarDigest(src string, opt *tar.Header, w io.Writer) (digest [32]byte, n int64, err error) {
+
+	s, cw := sha256.New(), &CountingWriter{W: w}
+	if err := Tar(src, opt, cw, s); err != nil {
+		return digest, cw.N, err
+	}
+	copy(digest[:], s.Sum(nil))
+
+	return digest, cw.N, nil
+}
+
+// TarSigned takes a source path and writes the archive to w the same as Tar
+// while computing its sha256 digest, then returns the signature signer makes
+// over that digest; the signing algorithm, such as Ed25519 or RSA, is left to
+// the caller so no key handling is needed here
+func TarSigned(src string, opt *tar.Header, signer func(digest []byte) ([]byte, error), w io.Writer) (signature []byte, err error) {
+
+	s := sha256.New()
+	if err := Tar(src, opt, w, s); err != nil {
+		return nil, err
+	}
+
+	return signer(s.Sum(nil))
+}
+
+// TarToHashedFile takes a source path and writes the archive into dir as
+// <sha256 hex>.tgz, named by the digest of its compressed bytes, for content
+// addressed artifact stores. The archive is written to a temporary file in
+// dir while hashing and then renamed, and the final path is returned.
+func TarToHashedFile(dir, src string, opt *tar.Header) (path string, err error) {
+
+	f, err := ioutil.TempFile(dir, ".tgz-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+
+	digest, _, err := TarDigest(src, opt, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	path = filepath.Join(dir, hex.EncodeToString(digest[:])+".tgz")
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// TreeHash takes an io.Reader of a tar.gz or plain tar stream and returns a
+// sha256 over the logical content of the archive alone: the sorted entry
+// names with the type, permissions, size, link target, and body sha256 of
+// each. Timestamps, owners, entry order, and the compression are left out,
+// so two archives of the same files and layout share a tree hash.
+func TreeHash(r io.Reader) ([]byte, error) {
+
+	var lines []string
+	err := Walk(r, func(header *tar.Header, body io.Reader) error {
+
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			return nil
+		}
+
+		h := sha256.New()
+		if _, err := io.Copy(h, body); err != nil {
+			return err
+		}
+
+		lines = append(lines, fmt.Sprintf("%s %c %o %d %s %x\n",
+			strconv.Quote(path.Clean(header.Name)), header.Typeflag, header.Mode&07777,
+			header.Size, strconv.Quote(header.Linkname), h.Sum(nil)))
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(lines)
+
+	h := sha256.New()
+	for _, line := range lines {
+		io.WriteString(h, line)
+	}
+
+	return h.Sum(nil), nil
+}
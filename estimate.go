@@ -0,0 +1,71 @@
+package tgz
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// sampleMin is the smallest piece of a file read for EstimateRatio, so a
+// large tree is sampled across evenly spaced files rather than a few bytes
+// from every one
+const sampleMin = 4 << 10
+
+// EstimateRatio gzips up to sampleBytes of the content under src, taken
+// from the start of files spread evenly across the tree, and returns the
+// compressed size over the sampled size. A result near 1.0 means the
+// content is already compressed and Store will save the CPU for little
+// loss. ErrEmpty is returned when there is no content to sample.
+func EstimateRatio(src string, sampleBytes int64) (float64, error) {
+
+	var files []string
+	err := filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && info.Size() > 0 {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(files) == 0 || sampleBytes <= 0 {
+		return 0, ErrEmpty
+	}
+
+	// the share of each file, and the stride over the files when a share
+	// would be too small to be representative
+	per, step := sampleBytes/int64(len(files)), 1
+	if per < sampleMin {
+		n := int(sampleBytes / sampleMin)
+		if n < 1 {
+			n = 1
+		}
+		step, per = (len(files)+n-1)/n, sampleBytes/int64(n)
+	}
+
+	cw := &CountingWriter{}
+	gzw := gzip.NewWriter(cw)
+
+	var sampled int64
+	for i := 0; i < len(files) && sampled < sampleBytes; i += step {
+		f, err := os.Open(files[i])
+		if err != nil {
+			return 0, err
+		}
+		n, err := io.CopyN(gzw, f, per)
+		f.Close()
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		sampled += n
+	}
+	if err := gzw.Close(); err != nil {
+		return 0, err
+	}
+
+	return float64(cw.N) / float64(sampled), nil
+}
@@ -0,0 +1,4 @@
+package tgz
+
+// paxFileFlags is the PAX record used by libarchive for file flags
+const paxFileFlags = "SCHILY.fflags"
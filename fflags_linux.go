@@ -0,0 +1,81 @@
+//go:build linux && (386 || amd64 || arm || arm64 || riscv64 || s390x || loong64)
+// +build linux
+// +build 386 amd64 arm arm64 riscv64 s390x loong64
+
+package tgz
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// inode flag ioctls, _IOR('f', 1, long) and _IOW('f', 2, long)
+const (
+	fsIocGetFlags = 2<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 1
+	fsIocSetFlags = 1<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 2
+)
+
+// fflagNames maps the inode flags to the names libarchive uses in the
+// SCHILY.fflags PAX record
+var fflagNames = []struct {
+	flag int32
+	name string
+}{
+	{0x00000010, "schg"},    // FS_IMMUTABLE_FL
+	{0x00000020, "sappnd"},  // FS_APPEND_FL
+	{0x00000040, "nodump"},  // FS_NODUMP_FL
+	{0x00000080, "noatime"}, // FS_NOATIME_FL
+}
+
+// getFileFlags returns the supported inode flags of file by name, or an
+// empty string when there are none or the filesystem has no inode flags
+func getFileFlags(file string) string {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	var flags int32 // the kernel reads an int despite the declared size
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocGetFlags, uintptr(unsafe.Pointer(&flags))); errno != 0 {
+		return ""
+	}
+
+	var names []string
+	for _, fn := range fflagNames {
+		if flags&fn.flag != 0 {
+			names = append(names, fn.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+// setFileFlags adds the named inode flags to file; this is best effort and
+// failures are ignored
+func setFileFlags(file string, list string) {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var flags int32 // the kernel reads an int despite the declared size
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocGetFlags, uintptr(unsafe.Pointer(&flags))); errno != 0 {
+		return
+	}
+
+	for _, name := range strings.Split(list, ",") {
+		for _, fn := range fflagNames {
+			if strings.TrimSpace(name) == fn.name {
+				flags |= fn.flag
+			}
+		}
+	}
+
+	syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocSetFlags, uintptr(unsafe.Pointer(&flags)))
+}
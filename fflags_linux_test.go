@@ -0,0 +1,59 @@
+package tgz_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/zxdez/tgz"
+)
+
+// inodeFlags gets or sets the inode flags of file through FS_IOC_GETFLAGS
+// and FS_IOC_SETFLAGS
+func inodeFlags(t *testing.T, file string, set int32) int32 {
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	req := uintptr(2<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 1)
+	if set != 0 {
+		req = uintptr(1<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 2)
+	}
+	flags := set
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(unsafe.Pointer(&flags))); errno != 0 {
+		t.Skip("inode flags not supported:", errno)
+	}
+
+	return flags
+}
+
+func TestFileFlags(t *testing.T) {
+
+	const nodump = 0x40 // FS_NODUMP_FL
+
+	src := t.TempDir()
+	file := filepath.Join(src, "a.txt")
+	ioutil.WriteFile(file, []byte("data"), 0644)
+	inodeFlags(t, file, inodeFlags(t, file, 0)|nodump)
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{FileFlags: true}, b); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if err := tgz.UntarWith(dst, b, &tgz.UntarOptions{FileFlags: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if inodeFlags(t, filepath.Join(dst, "a.txt"), 0)&nodump == 0 {
+		t.Fatal("nodump flag not restored")
+	}
+}
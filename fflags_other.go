@@ -0,0 +1,10 @@
+//go:build !linux || !(386 || amd64 || arm || arm64 || riscv64 || s390x || loong64)
+// +build !linux !386,!amd64,!arm,!arm64,!riscv64,!s390x,!loong64
+
+package tgz
+
+// getFileFlags is a no-op where inode flags are not supported
+func getFileFlags(file string) string { return "" }
+
+// setFileFlags is a no-op where inode flags are not supported
+func setFileFlags(file string, list string) {}
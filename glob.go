@@ -0,0 +1,93 @@
+package tgz
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// TarGlob writes an archive of each regular file matching the
+// filepath.Glob pattern, such as "logs/*.log", as TarFiles does. A pattern
+// without matches writes an empty archive.
+func TarGlob(pattern string, opt *tar.Header, writers ...io.Writer) error {
+	return TarGlobWith(pattern, opt, nil, writers...)
+}
+
+// TarGlobWith is TarGlob with the extended settings in o applied; set
+// RequireEntries to have a pattern without matches return ErrEmpty
+func TarGlobWith(pattern string, opt *tar.Header, o *TarOptions, writers ...io.Writer) error {
+
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+
+	return TarFilesWith(files, opt, o, writers...)
+}
+
+// TarFiles writes an archive of the listed files, each stored under its
+// base name with the same header logic as Tar. Anything that is not a
+// regular file is skipped, and two files sharing a base name return
+// ErrDuplicate.
+func TarFiles(files []string, opt *tar.Header, writers ...io.Writer) error {
+	return TarFilesWith(files, opt, nil, writers...)
+}
+
+// TarFilesWith is TarFiles with the extended settings in o applied; pass o
+// as nil to use the defaults. The files share one walk, so options over the
+// whole archive, such as Dedup and WithChecksums, span all of them.
+func TarFilesWith(files []string, opt *tar.Header, o *TarOptions, writers ...io.Writer) error {
+
+	// apply default options when nil is passed
+	if o == nil {
+		o = &TarOptions{}
+	}
+
+	// keep the regular files, failing on names that would collide
+	var regular []string
+	names := make(map[string]bool)
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		name := filepath.Base(file)
+		if names[name] {
+			return fmt.Errorf("%w: %q", ErrDuplicate, name)
+		}
+		names[name] = true
+		regular = append(regular, file)
+	}
+	if len(regular) == 0 && o.RequireEntries {
+		return ErrEmpty
+	}
+
+	// the files are checked above, not by the walk
+	each := *o
+	each.RequireEntries = false
+
+	// every file keeps its base name
+	if opt != nil && opt.Name != "" {
+		unnamed := *opt
+		unnamed.Name = ""
+		opt = &unnamed
+	}
+
+	// the output layers over a writer that duplicates its writes
+	w, finish, err := o.layers(io.MultiWriter(writers...), nil, regular...)
+	if err != nil {
+		return err
+	}
+
+	err = tarTo(w, opt, &each, regular...)
+	if ferr := finish(); err == nil {
+		err = ferr
+	}
+
+	return err
+}
@@ -0,0 +1,78 @@
+package tgz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// Gzip takes a bytes.Buffer and writes it as a plain gzip stream without the
+// tar wrapper, returning the uncompressed byte count.
+//
+// Pass multiple writers to create a .gz that duplicates writes to generate
+// the file as well as generate a md5 or sha256 hash at the same time.
+func Gzip(b *bytes.Buffer, w ...io.Writer) (int64, error) {
+
+	// create a writer that duplicates its writes
+	mw := io.MultiWriter(w...)
+
+	gzw := gzip.NewWriter(mw) // compression
+	n, err := io.Copy(gzw, b)
+	if cerr := gzw.Close(); err == nil {
+		err = cerr
+	}
+
+	return n, err
+}
+
+// Gunzip takes a gzip stream and writes the decompressed content to dst,
+// returning the decompressed byte count
+func Gunzip(dst io.Writer, r io.Reader) (int64, error) {
+
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer gzr.Close()
+
+	return io.Copy(dst, gzr)
+}
+
+// Recompress takes a gzip stream, such as a tar.gz archive, and writes it to
+// out compressed again at level, one of the compress/gzip levels. The
+// decompressed content and the gzip header fields are carried over untouched.
+func Recompress(out io.Writer, r io.Reader, level int) error {
+
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	gzw, err := gzip.NewWriterLevel(out, level)
+	if err != nil {
+		return err
+	}
+	gzw.Header = gzr.Header
+
+	_, err = io.Copy(gzw, gzr)
+	if cerr := gzw.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// GzipHeader reads only the gzip header of r, such as a tar.gz archive, and
+// returns its Name, Comment, ModTime, and other fields without decompressing
+// the content
+func GzipHeader(r io.Reader) (*gzip.Header, error) {
+
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+
+	return &gzr.Header, nil
+}
@@ -0,0 +1,32 @@
+package tgz
+
+import "archive/tar"
+
+// DefaultHeader returns the header settings used when opt is passed as nil
+func DefaultHeader() *tar.Header {
+	return &tar.Header{Mode: 0644, Gname: "user", Uname: "user"}
+}
+
+// ApplyDefaults returns a copy of h with any empty Gname, Uname, or Mode set
+// from DefaultHeader, or DefaultHeader itself when h is nil. Every function
+// in this package that accepts an opt header applies it the same way.
+func ApplyDefaults(h *tar.Header) *tar.Header {
+
+	d := DefaultHeader()
+	if h == nil {
+		return d
+	}
+
+	c := *h
+	if c.Gname == "" {
+		c.Gname = d.Gname
+	}
+	if c.Uname == "" {
+		c.Uname = d.Uname
+	}
+	if c.Mode == 0 {
+		c.Mode = d.Mode
+	}
+
+	return &c
+}
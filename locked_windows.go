@@ -0,0 +1,17 @@
+package tgz
+
+import (
+	"errors"
+	"syscall"
+)
+
+// windows errors reported when another process holds the file open
+const (
+	errSharingViolation syscall.Errno = 32 // ERROR_SHARING_VIOLATION
+	errLockViolation    syscall.Errno = 33 // ERROR_LOCK_VIOLATION
+)
+
+// isLocked reports whether err is a sharing or lock violation
+func isLocked(err error) bool {
+	return errors.Is(err, errSharingViolation) || errors.Is(err, errLockViolation)
+}
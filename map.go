@@ -0,0 +1,40 @@
+package tgz
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// UntarMap takes an io.Reader of a tar.gz stream and returns the contents of
+// each regular file keyed by its entry name; directories are skipped. Entry
+// names are validated the same as Untar even though nothing touches disk.
+func UntarMap(r io.Reader) (map[string][]byte, error) {
+
+	files := make(map[string][]byte)
+
+	err := Walk(r, func(header *tar.Header, tr io.Reader) error {
+
+		if err := validName(header.Name); err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("tgz: read %q: %w", header.Name, err)
+		}
+		files[header.Name] = b
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
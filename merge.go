@@ -0,0 +1,55 @@
+package tgz
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Merge takes one or more tar.gz streams and writes all of their entries, in
+// order, into a single tar.gz stream on dst without extracting anything.
+// Headers are copied as is, so modes and times are preserved exactly, and a
+// name appearing in more than one entry returns ErrDuplicate.
+func Merge(dst io.Writer, srcs ...io.Reader) error {
+
+	gzw := gzip.NewWriter(dst) // compression
+	tw := tar.NewWriter(gzw)   // tarball
+
+	seen := make(map[string]bool)
+	var err error
+	for _, src := range srcs {
+		err = Walk(src, func(header *tar.Header, body io.Reader) error {
+
+			if header.Typeflag == tar.TypeXGlobalHeader {
+				return nil
+			}
+
+			if seen[header.Name] {
+				return fmt.Errorf("%w: %q", ErrDuplicate, header.Name)
+			}
+			seen[header.Name] = true
+
+			if err := tw.WriteHeader(header); err != nil {
+				return fmt.Errorf("tgz: merge %q: %w", header.Name, err)
+			}
+			if _, err := io.Copy(tw, body); err != nil {
+				return fmt.Errorf("tgz: merge %q: %w", header.Name, err)
+			}
+
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+
+	if cerr := tw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := gzw.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
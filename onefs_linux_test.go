@@ -0,0 +1,59 @@
+package tgz_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/zxdez/tgz"
+)
+
+func TestTarOneFileSystem(t *testing.T) {
+
+	src := t.TempDir()
+	os.Mkdir(filepath.Join(src, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "sub", "b.txt"), []byte("b"), 0644)
+
+	names := func(o *tgz.TarOptions) []string {
+		b := new(bytes.Buffer)
+		if err := tgz.TarWith(src, nil, o, b); err != nil {
+			t.Fatal(err)
+		}
+		headers, err := tgz.List(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, h := range headers {
+			names = append(names, h.Name)
+		}
+		return names
+	}
+
+	// a tree on a single device is unchanged
+	want := []string{"a.txt", "sub/b.txt"}
+	if got := names(&tgz.TarOptions{OneFileSystem: true}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("single device: entries %q, want %q", got, want)
+	}
+
+	// a tmpfs mounted inside the tree is left out
+	mnt := filepath.Join(src, "mnt")
+	os.Mkdir(mnt, 0755)
+	if err := syscall.Mount("tmpfs", mnt, "tmpfs", 0, ""); err != nil {
+		t.Skipf("mount tmpfs: %v", err)
+	}
+	defer syscall.Unmount(mnt, 0)
+	ioutil.WriteFile(filepath.Join(mnt, "c.txt"), []byte("c"), 0644)
+
+	if got := names(nil); !reflect.DeepEqual(got, []string{"a.txt", "mnt/c.txt", "sub/b.txt"}) {
+		t.Fatalf("without the option: entries %q", got)
+	}
+	if got := names(&tgz.TarOptions{OneFileSystem: true}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("other device: entries %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,133 @@
+package tgz
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// sortedWalk has the same contract as filepath.Walk but reads each directory
+// itself and orders the entries with a plain byte-wise comparison, so the
+// visiting order never depends on the platform or the filesystem
+func sortedWalk(root string, fn filepath.WalkFunc) error {
+
+	info, err := os.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = sortedWalkDir(root, info, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+
+	return err
+}
+
+// sortedWalkDir visits path and, when it is a directory, its sorted entries
+func sortedWalkDir(path string, info os.FileInfo, fn filepath.WalkFunc) error {
+
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+
+	names, err := readDirNames(path)
+	if err1 := fn(path, info, err); err != nil || err1 != nil {
+		return err1
+	}
+
+	for _, name := range names {
+		file := filepath.Join(path, name)
+		fi, err := os.Lstat(file)
+		if err != nil {
+			if err := fn(file, fi, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if err := sortedWalkDir(file, fi, fn); err != nil {
+			if !fi.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// readDirNames returns the entry names of dir in byte-wise order
+func readDirNames(dir string) ([]string, error) {
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+
+	return names, nil
+}
+
+// orderedWalk has the same contract as filepath.Walk but collects every path
+// in a pre-pass, reorders them with order, and then visits them in that order
+func orderedWalk(root string, order func(paths []string) []string, fn filepath.WalkFunc) error {
+
+	infos := make(map[string]os.FileInfo)
+	var paths []string
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fn(file, info, err)
+		}
+		infos[file] = info
+		paths = append(paths, file)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var skip []string // directories skipped by fn
+	for _, file := range order(paths) {
+
+		info, ok := infos[file]
+		if !ok || skipped(skip, file) {
+			continue
+		}
+
+		if err := fn(file, info, nil); err != nil {
+			if err != filepath.SkipDir {
+				return err
+			}
+			if info.IsDir() {
+				skip = append(skip, file+string(filepath.Separator))
+			}
+		}
+	}
+
+	return nil
+}
+
+// skipped reports whether file is within one of the skipped directories
+func skipped(skip []string, file string) bool {
+	for _, dir := range skip {
+		if strings.HasPrefix(file, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortPaths orders paths by a byte-wise comparison of their slash separated
+// form, which is identical on every platform
+func sortPaths(paths []string) []string {
+	sort.Slice(paths, func(i, j int) bool {
+		return filepath.ToSlash(paths[i]) < filepath.ToSlash(paths[j])
+	})
+	return paths
+}
@@ -0,0 +1,110 @@
+package tgz
+
+import (
+	"archive/tar"
+	"bytes"
+	"sync"
+)
+
+// prefetchMax is the largest body read ahead into memory; larger files are
+// copied straight from disk by the tar writer when their turn comes
+const prefetchMax = 1 << 20
+
+// prefetcher reads file bodies with a bounded pool of goroutines while a
+// single goroutine writes the entries to the tar writer in their original
+// order, since the tar stream itself is sequential
+type prefetcher struct {
+	tw     *tar.Writer
+	sem    chan struct{} // bounds the concurrent reads
+	queue  chan *fetch   // entries in archive order
+	done   chan struct{} // closed when the writer goroutine exits
+	failed chan struct{} // closed on the first write error
+	once   sync.Once
+	err    error
+}
+
+// fetch is a single entry and its read-ahead body
+type fetch struct {
+	header *tar.Header
+	file   string
+	body   *bytes.Buffer
+	err    error
+	ready  chan struct{}
+}
+
+// newPrefetcher starts the writer goroutine reading with workers goroutines
+func newPrefetcher(tw *tar.Writer, workers int) *prefetcher {
+
+	p := &prefetcher{
+		tw:     tw,
+		sem:    make(chan struct{}, workers),
+		queue:  make(chan *fetch, workers*2),
+		done:   make(chan struct{}),
+		failed: make(chan struct{}),
+	}
+	go p.write()
+
+	return p
+}
+
+// put queues the header and the body of file, when file is not empty
+func (p *prefetcher) put(header *tar.Header, file string) error {
+
+	f := &fetch{header: header, file: file, ready: make(chan struct{})}
+
+	if file != "" && header.Size <= prefetchMax {
+		p.sem <- struct{}{}
+		go func() {
+			f.body = bytes.NewBuffer(make([]byte, 0, header.Size))
+			f.err = copyFile(f.body, file, header.Size)
+			<-p.sem
+			close(f.ready)
+		}()
+	} else {
+		close(f.ready)
+	}
+
+	select {
+	case p.queue <- f:
+		return nil
+	case <-p.failed:
+		return p.err
+	}
+}
+
+// close waits for the queued entries to be written
+func (p *prefetcher) close() error {
+	close(p.queue)
+	<-p.done
+	return p.err
+}
+
+// write writes the queued entries in order, draining the queue without
+// writing after the first error
+func (p *prefetcher) write() {
+
+	defer close(p.done)
+
+	for f := range p.queue {
+
+		if p.err != nil {
+			continue
+		}
+
+		<-f.ready
+		err := f.err
+		if err == nil {
+			err = p.tw.WriteHeader(f.header)
+		}
+		if err == nil && f.body != nil {
+			_, err = f.body.WriteTo(p.tw)
+		} else if err == nil && f.file != "" {
+			err = copyFile(p.tw, f.file, f.header.Size)
+		}
+
+		if err != nil {
+			p.err = err
+			p.once.Do(func() { close(p.failed) })
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package tgz
+
+import (
+	"archive/tar"
+	"io"
+)
+
+// Reader streams the archive of a source path as an io.Reader. The archive
+// is generated on demand, so nothing is buffered beyond what the caller reads.
+type Reader struct {
+	src string
+	opt *tar.Header
+	o   *TarOptions
+	pr  *io.PipeReader
+}
+
+// TarReader returns a Reader that produces the archive of src using the same
+// opt settings as Tar. Reader implements io.WriterTo so io.Copy writes the
+// archive straight to the destination without an intermediate pipe.
+func TarReader(src string, opt *tar.Header, o *TarOptions) *Reader {
+	return &Reader{src: src, opt: opt, o: o}
+}
+
+// Read reads the next bytes of the archive, starting the archive
+// generation on the first call
+func (r *Reader) Read(p []byte) (int, error) {
+
+	if r.pr == nil {
+		pr, pw := io.Pipe()
+		go func() { pw.CloseWithError(TarWith(r.src, r.opt, r.o, pw)) }()
+		r.pr = pr
+	}
+
+	return r.pr.Read(p)
+}
+
+// WriteTo writes the archive to w and returns the compressed byte count
+func (r *Reader) WriteTo(w io.Writer) (int64, error) {
+
+	// generation already started by Read, so drain what remains
+	if r.pr != nil {
+		return io.Copy(w, r.pr)
+	}
+
+	cw := &CountingWriter{W: w}
+	err := TarWith(r.src, r.opt, r.o, cw)
+
+	return cw.N, err
+}
+
+// Close stops the archive generation when the Reader is abandoned early
+func (r *Reader) Close() error {
+	if r.pr == nil {
+		return nil
+	}
+	return r.pr.Close()
+}
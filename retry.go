@@ -0,0 +1,64 @@
+package tgz
+
+import (
+	"archive/tar"
+	"io"
+)
+
+// TarWithRetry writes the archive of src to a destination from newWriter
+// and, when writing to it fails, such as on a network blip during an upload,
+// closes it, asks newWriter for a fresh destination, and archives src again
+// from the start, up to attempts times in all. Discarding the partial output
+// of a failed attempt is left to the destination. Errors reading src are not
+// retried, and the last error is returned once attempts run out; an
+// attempts below one makes a single attempt.
+func TarWithRetry(src string, opt *tar.Header, attempts int, newWriter func() (io.WriteCloser, error)) error {
+
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+
+		var w io.WriteCloser
+		if w, err = newWriter(); err != nil {
+			continue
+		}
+
+		ew := &errWriter{w: w}
+		terr := Tar(src, opt, ew)
+		cerr := w.Close()
+		switch {
+		case terr == nil && cerr == nil:
+			return nil
+
+		case terr != nil && ew.err == nil:
+			return terr // the source failed, not the destination
+
+		case terr != nil:
+			err = terr
+
+		default:
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// errWriter records the first error of writing to w
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) Write(p []byte) (int, error) {
+
+	n, err := ew.w.Write(p)
+	if err != nil && ew.err == nil {
+		ew.err = err
+	}
+
+	return n, err
+}
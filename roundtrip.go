@@ -0,0 +1,102 @@
+package tgz
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RoundTrip archives src into memory with Tar, extracts it with Untar into
+// a temporary directory, and compares every regular file of both trees by
+// name, size, and sha256 of the content, returning an error that names each
+// divergence. Modes are not compared: Tar records opt.Mode rather than the
+// source permissions, and Untar creates files through the umask.
+func RoundTrip(src string) error {
+
+	b := new(bytes.Buffer)
+	if err := Tar(src, nil, b); err != nil {
+		return err
+	}
+	archive := b.Bytes()
+
+	dst, err := ioutil.TempDir("", "tgz-roundtrip-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dst)
+
+	if err := Untar(dst, bytes.NewReader(archive)); err != nil {
+		return err
+	}
+
+	// a single file is archived under its base name
+	root := src
+	if info, err := os.Stat(src); err == nil && !info.IsDir() {
+		root = filepath.Dir(src)
+	}
+
+	want, err := treeFiles(root, src)
+	if err != nil {
+		return err
+	}
+	got, err := treeFiles(dst, dst)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	for name, w := range want {
+		g, ok := got[name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%q missing", name))
+		case g.size != w.size:
+			problems = append(problems, fmt.Sprintf("%q size %d, want %d", name, g.size, w.size))
+		case g.sum != w.sum:
+			problems = append(problems, fmt.Sprintf("%q content differs", name))
+		}
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			problems = append(problems, fmt.Sprintf("%q unexpected", name))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("tgz: round trip of %s: %s", src, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// treeFile is the compared state of a regular file
+type treeFile struct {
+	size int64
+	sum  string
+}
+
+// treeFiles returns the regular files found walking from, keyed by their
+// slash separated path relative to root
+func treeFiles(root, from string) (map[string]treeFile, error) {
+
+	files := make(map[string]treeFile)
+	err := filepath.Walk(from, func(file string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		name, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(file)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(name)] = treeFile{size: info.Size(), sum: sum}
+		return nil
+	})
+
+	return files, err
+}
@@ -0,0 +1,25 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package tgz
+
+import (
+	"archive/tar"
+	"syscall"
+)
+
+// mknod creates the named pipe of header at target; device numbers are
+// encoded differently on each of these systems, so devices are skipped
+func mknod(target string, header *tar.Header) (bool, error) {
+
+	if header.Typeflag != tar.TypeFifo {
+		return false, nil
+	}
+
+	err := syscall.Mkfifo(target, uint32(header.Mode&07777))
+	if err == syscall.EPERM {
+		return false, nil
+	}
+
+	return err == nil, err
+}
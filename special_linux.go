@@ -0,0 +1,32 @@
+package tgz
+
+import (
+	"archive/tar"
+	"syscall"
+)
+
+// mknod creates the device or named pipe node of header at target,
+// reporting false when the process lacks the privilege to do so
+func mknod(target string, header *tar.Header) (bool, error) {
+
+	mode := uint32(header.Mode & 07777)
+	switch header.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+
+	// the glibc makedev encoding of the major and minor numbers
+	major, minor := uint64(header.Devmajor), uint64(header.Devminor)
+	dev := minor&0xff | major&0xfff<<8 | minor&^0xff<<12 | major&^0xfff<<32
+
+	err := syscall.Mknod(target, mode, int(dev))
+	if err == syscall.EPERM {
+		return false, nil
+	}
+
+	return err == nil, err
+}
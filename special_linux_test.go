@@ -0,0 +1,46 @@
+package tgz_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zxdez/tgz"
+)
+
+func TestUntarRestoreSpecial(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	tw.WriteHeader(&tar.Header{Name: "pipe", Typeflag: tar.TypeFifo, Mode: 0640})
+	tw.WriteHeader(&tar.Header{Name: "null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3})
+	tw.Close()
+
+	dst := t.TempDir()
+	if err := tgz.UntarWith(dst, b, &tgz.UntarOptions{RestoreSpecial: true, Strict: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(filepath.Join(dst, "pipe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 || info.Mode().Perm() != 0640 {
+		t.Fatalf("pipe mode %v", info.Mode())
+	}
+
+	// a device needs root and is skipped without it
+	info, err = os.Lstat(filepath.Join(dst, "null"))
+	switch {
+	case os.Geteuid() != 0:
+		if !os.IsNotExist(err) {
+			t.Fatal("device created without privilege")
+		}
+	case err != nil:
+		t.Fatal(err)
+	case info.Mode()&os.ModeCharDevice == 0:
+		t.Fatalf("device mode %v", info.Mode())
+	}
+}
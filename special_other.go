@@ -0,0 +1,9 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package tgz
+
+import "archive/tar"
+
+// mknod is not supported, so the node is skipped
+func mknod(target string, header *tar.Header) (bool, error) { return false, nil }
@@ -0,0 +1,103 @@
+package tgz
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// TarSplit takes a source path and writes the compressed archive across
+// multiple volume files of at most volumeSize bytes each. The namePattern is
+// a fmt verb pattern that receives the volume number starting at 1, such as
+// "archive.tgz.%03d" to generate archive.tgz.001, archive.tgz.002, etc.
+func TarSplit(src string, opt *tar.Header, volumeSize int64, namePattern string) error {
+
+	if volumeSize <= 0 {
+		return errors.New("tgz: volume size must be positive")
+	}
+
+	sw := &splitWriter{pattern: namePattern, size: volumeSize}
+	err := Tar(src, opt, sw)
+	if cerr := sw.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// UntarSplit takes a destination path and the namePattern used by TarSplit
+// and reads the volumes in order as a single archive stream
+func UntarSplit(dst string, namePattern string) error {
+
+	var readers []io.Reader
+	for i := 1; ; i++ {
+		f, err := os.Open(fmt.Sprintf(namePattern, i))
+		if os.IsNotExist(err) && i > 1 {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	return Untar(dst, io.MultiReader(readers...))
+}
+
+// splitWriter rolls writes over to a new volume file whenever
+// the current volume reaches size bytes
+type splitWriter struct {
+	pattern string   // volume name pattern
+	size    int64    // maximum volume size
+	n       int      // current volume number
+	f       *os.File // current volume
+	written int64    // bytes written to current volume
+}
+
+func (sw *splitWriter) Write(p []byte) (int, error) {
+
+	var total int
+	for len(p) > 0 {
+
+		// roll to the next volume when none is open or the current is full
+		if sw.f == nil || sw.written == sw.size {
+			if err := sw.Close(); err != nil {
+				return total, err
+			}
+			sw.n++
+			f, err := os.Create(fmt.Sprintf(sw.pattern, sw.n))
+			if err != nil {
+				return total, err
+			}
+			sw.f, sw.written = f, 0
+		}
+
+		chunk := p
+		if remain := sw.size - sw.written; int64(len(chunk)) > remain {
+			chunk = chunk[:remain]
+		}
+
+		n, err := sw.f.Write(chunk)
+		total += n
+		sw.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+	}
+
+	return total, nil
+}
+
+// Close closes the current volume
+func (sw *splitWriter) Close() error {
+	if sw.f == nil {
+		return nil
+	}
+	err := sw.f.Close()
+	sw.f = nil
+	return err
+}
@@ -0,0 +1,83 @@
+package tgz
+
+import (
+	"bufio"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// TextConvert selects the entries whose line endings are rewritten during
+// extraction; entries with other extensions pass through untouched
+type TextConvert struct {
+	Extensions []string // extensions to convert such as ".txt" or ".go"
+	CRLF       bool     // convert to CRLF line endings, otherwise to LF
+}
+
+// match reports whether name has one of the text extensions
+func (tc *TextConvert) match(name string) bool {
+
+	ext := filepath.Ext(name)
+	for _, e := range tc.Extensions {
+		if strings.EqualFold(ext, e) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reader wraps r with the line ending translation
+func (tc *TextConvert) reader(r io.Reader) io.Reader {
+	return &eolReader{r: bufio.NewReader(r), crlf: tc.CRLF}
+}
+
+// eolReader translates line endings to LF or CRLF as it reads
+type eolReader struct {
+	r       *bufio.Reader
+	crlf    bool
+	prev    byte // last byte read from r
+	pending byte // byte owed to the next Read
+}
+
+func (e *eolReader) Read(p []byte) (int, error) {
+
+	var n int
+	for n < len(p) {
+
+		if e.pending != 0 {
+			p[n], e.pending = e.pending, 0
+			n++
+			continue
+		}
+
+		c, err := e.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+
+		switch {
+		case !e.crlf && c == '\r':
+			// drop the CR of a CRLF pair
+			if next, err := e.r.Peek(1); err == nil && next[0] == '\n' {
+				continue
+			}
+
+		case e.crlf && c == '\n' && e.prev != '\r':
+			// a bare LF gains a CR
+			e.prev = c
+			p[n], e.pending = '\r', '\n'
+			n++
+			continue
+		}
+
+		e.prev = c
+		p[n] = c
+		n++
+	}
+
+	return n, nil
+}
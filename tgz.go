@@ -26,40 +26,99 @@ package tgz
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// ErrChanged is returned when a source file changes size while it is being
+// written to the archive
+var ErrChanged = errors.New("tgz: file changed size during archiving")
+
+// ErrDuplicate is returned when an entry name appears more than once
+var ErrDuplicate = errors.New("tgz: duplicate entry name")
+
+// ErrEmpty is returned with RequireEntries when no entries were archived
+var ErrEmpty = errors.New("tgz: no entries archived")
+
+// ErrUnsafePath is returned when an archive entry name is empty, absolute, or
+// would resolve outside of the extraction destination
+var ErrUnsafePath = errors.New("tgz: unsafe entry path")
+
+// ErrMissingDir is returned with VerifyDirs when a directory entry did not
+// result in a directory after extraction
+var ErrMissingDir = errors.New("tgz: directory entry not created")
+
+// ErrSize is returned when an archive entry declares a negative size, or a
+// Source body holds more bytes than its Size
+var ErrSize = errors.New("tgz: invalid entry size")
+
+// ErrTooLarge is returned when an archive entry exceeds the MaxFileBytes
+// extraction limit
+var ErrTooLarge = errors.New("tgz: entry exceeds size limit")
+
+// ErrSkip is returned by an Inspect function to skip the entry rather than
+// abort the extraction
+var ErrSkip = errors.New("tgz: skip this entry")
+
+// ErrTooDeep is returned when an archive entry name has more path
+// components than the MaxDepth extraction limit
+var ErrTooDeep = errors.New("tgz: entry path too deep")
+
+// ErrUnsupportedType is returned in strict mode for an archive entry that is
+// not a regular file, directory, or link
+var ErrUnsupportedType = errors.New("tgz: unsupported entry type")
+
 // Bytes takes a bytes.Buffer and writes an archinve file. Pass opt as nil to
 // use default value or specify Name, Gname, Uname, Mode, and ModTime in opt.
+// The returned count is the uncompressed size of the content; add a
+// CountingWriter to the writers for the compressed archive size.
 //
 // Pass multiple writers to create an archive that duplicates writes to generate
 // an archive as well as generate a md5 or sha25 hash at the same time.
 func Bytes(b *bytes.Buffer, opt *tar.Header, w ...io.Writer) (int64, error) {
+	return BytesWith(b, opt, nil, w...)
+}
 
-	// apply default options when nil is passed
-	if opt == nil {
-		opt = &tar.Header{
-			Name:    time.Now().UTC().Format("20060102T150405"),
-			Gname:   "user",
-			Uname:   "user",
-			Mode:    0644,
-			ModTime: time.Now().UTC().Round(time.Second),
-		}
+// BytesWith is Bytes with the extended settings in o applied, of which only
+// Store affects a single buffer; pass o as nil to use the defaults
+func BytesWith(b *bytes.Buffer, opt *tar.Header, o *TarOptions, w ...io.Writer) (int64, error) {
+
+	// apply default options when nil or empty
+	opt = ApplyDefaults(opt)
+	if opt.Name == "" {
+		opt.Name = time.Now().UTC().Format("20060102T150405")
+	}
+	if opt.ModTime.IsZero() {
+		opt.ModTime = time.Now().UTC().Round(time.Second)
 	}
 
 	// create a writer that duplicates its writes
-	mw := io.MultiWriter(w...)
+	var mw io.Writer = io.MultiWriter(w...)
 
-	gzw := gzip.NewWriter(mw) // compression
-	defer gzw.Close()
+	if o == nil || !o.Store {
+		gzw := gzip.NewWriter(mw) // compression
+		defer gzw.Close()
+		mw = gzw
+	}
 
-	tw := tar.NewWriter(gzw) // tarball
+	tw := tar.NewWriter(mw) // tarball
 	defer tw.Close()
 
 	// write a header to the tarball archive
@@ -77,153 +136,1952 @@ func Bytes(b *bytes.Buffer, opt *tar.Header, w ...io.Writer) (int64, error) {
 
 }
 
+// File writes a single file archive holding data as name with the given
+// permission mode, using the Bytes defaults for everything else
+func File(name string, data []byte, mode int64, w ...io.Writer) (int64, error) {
+	return Bytes(bytes.NewBuffer(data), &tar.Header{Name: name, Mode: mode}, w...)
+}
+
+// AppendBytes writes the archive of b, as Bytes does, into a buffer backed
+// by dst and returns the grown slice, so that a hot path can reuse one
+// slice, say from a sync.Pool, instead of allocating per archive
+func AppendBytes(dst []byte, b *bytes.Buffer, opt *tar.Header) ([]byte, error) {
+
+	out := bytes.NewBuffer(dst[:0])
+	if _, err := Bytes(b, opt, out); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
 // Tar takes a source path along with one or more writers and then writes the file
 // or walks the directory writing each file found to the tar writer. Pass opt as nil
 // to use defaults, opt will accept custom Gname, Uname, Mode, and ModTime for custom
 // header settings for the file header. Execuable files are always ignored.
+// When src is a single file, a non-empty opt.Name names its entry in place of
+// the base name of src.
 //
 // Pass multiple writers to create an archive that duplicates its writes go generate
-// an archive as well as generate a md5 or sha25 hash at the same time.
+// an archive as well as generate a md5 or sha25 hash at the same time, or add a
+// CountingWriter for the compressed archive size.
 func Tar(src string, opt *tar.Header, writers ...io.Writer) error {
+	return TarWith(src, opt, nil, writers...)
+}
 
-	// apply default options when nil is passed
-	if opt == nil {
-		opt = &tar.Header{Mode: 0644, Gname: "user", Uname: "user"}
-	}
+// TarOptions are the extended settings for TarWith; the zero value
+// archives exactly the same as Tar
+type TarOptions struct {
+
+	// Dedup hashes each file and writes a hard link entry referencing the
+	// first file with the same content in place of any duplicate body
+	Dedup bool
+
+	// ContentAddressed stores each unique body once as blobs/<sha256> and
+	// finishes the archive with a manifest.json entry mapping each original
+	// path to its hash
+	ContentAddressed bool
+
+	// PreserveCaps records the Linux security.capability xattr of each file
+	// in the SCHILY.xattr.security.capability PAX record, the same key GNU
+	// tar --xattrs uses, so that UntarWith or tar can restore it
+	PreserveCaps bool
+
+	// BirthTime records the file creation time in the PAX records where the
+	// platform reports it, and is silently skipped elsewhere
+	BirthTime bool
+
+	// Sorted reads each directory and writes its entries ordered by a plain
+	// byte-wise name comparison, guaranteeing the same entry order for the
+	// same tree on every platform and filesystem
+	Sorted bool
+
+	// Workers reads up to this many file bodies concurrently ahead of the
+	// tar writer, which still writes the entries serially in walk order;
+	// zero or one reads each file only when it is written
+	Workers int
+
+	// BodyTransform rewrites each file body, for example through a stream
+	// cipher, before it enters the archive. A tar header must declare the
+	// exact body size up front and a transform may change it, so every
+	// transformed body is first spooled to a temporary file to be measured;
+	// expect that extra disk I/O, and Workers is ignored with a transform.
+	BodyTransform func(name string, r io.Reader) (io.Reader, error)
+
+	// SmallFileBytes reads files below this size whole into a pooled buffer
+	// and hands the body to the tar writer in a single Write, cutting the
+	// per file overhead for trees of many tiny files; zero disables it
+	SmallFileBytes int64
+
+	// LatestModTime sets the gzip header ModTime to the newest modification
+	// time found in src, found with a pre-pass over the tree, so the archive
+	// carries the point in time it represents
+	LatestModTime bool
+
+	// RequireEntries returns ErrEmpty when nothing was archived, such as for
+	// an empty directory, to tell "nothing to do" apart from success
+	RequireEntries bool
+
+	// SortEntries collects every path in a pre-pass and writes the entries
+	// ordered by a byte-wise comparison of their full slash separated path,
+	// so the archive layout is identical on Linux, macOS, and Windows
+	SortEntries bool
+
+	// WithChecksums hashes each archived body and finishes the archive with
+	// a SHA256SUMS entry of "<hex>  <name>" lines, as sha256sum writes them,
+	// so the content can be verified after extraction
+	WithChecksums bool
+
+	// EmbedChecksums hashes the files in a pre-pass and starts the archive
+	// with their SHA256SUMS entry, in the same format as WithChecksums, so
+	// a streaming reader has the checksums before the bodies; it reads every
+	// file twice. WithChecksums is ignored alongside it, and it can not be
+	// combined with BodyTransform, which need not repeat its output.
+	EmbedChecksums bool
+
+	// Store writes a plain tar without the gzip layer, which saves the CPU
+	// spent compressing payloads that are already compressed such as media;
+	// Untar detects the missing gzip layer and reads it the same
+	Store bool
+
+	// Dirs writes an entry for every directory, so empty directories
+	// survive the round trip. Directory entries carry their own permissions
+	// rather than opt.Mode, which applies to files, unless DirMode is set.
+	Dirs bool
+
+	// DirsFirst writes an entry for each directory ahead of the first entry
+	// inside it, whether or not Dirs is set and whatever the entry order,
+	// for strict readers that require the parent of a file to be listed
+	// before the file; directories that exist only in the archive, as for a
+	// single file named a/b/f.txt or a Writer entry, are synthesized
+	DirsFirst bool
+
+	// SkipEmpty leaves regular files of zero length out of the archive, such
+	// as .gitkeep placeholders; directory entries written for Dirs are kept
+	SkipEmpty bool
+
+	// DirMode is the mode applied to every directory entry written with
+	// Dirs; zero keeps the mode of each source directory
+	DirMode int64
+
+	// FileFlags records the Linux inode flags of each file, such as
+	// immutable and append-only, in the SCHILY.fflags PAX record; this is
+	// best effort and skipped where the flags are not supported
+	FileFlags bool
+
+	// SkipLocked skips a file that cannot be opened because another process
+	// holds it open, a Windows sharing or lock violation, instead of failing
+	// the whole archive, and reports it to Locked when set
+	SkipLocked bool
+	Locked     func(file string, err error)
+
+	// Symlinks archives symbolic links as link entries holding their target
+	// rather than skipping them
+	Symlinks bool
+
+	// RelativeSymlinks rewrites absolute link targets that point inside src
+	// into targets relative to the link, so the archived links stay portable,
+	// and fails with ErrUnsafePath on a link that points outside of src
+	RelativeSymlinks bool
+
+	// OneFileSystem does not descend into directories on a different device
+	// than src, like tar --one-file-system, so mounts such as /proc or a
+	// network share are left out; it has no effect on Windows
+	OneFileSystem bool
+
+	// PAXRecords are archive level metadata, such as a commit or build id,
+	// written in a global extended header at the start of the archive;
+	// Walk and List report it as the first entry, typed TypeXGlobalHeader
+	PAXRecords map[string]string
+
+	// Skipped is called with the path of each file left out of the archive
+	// for not being a regular file, such as a socket, device, or named pipe,
+	// so a backup can be audited for what it excludes
+	Skipped func(file string)
+
+	// GzipHeader fixes the Name, Comment, ModTime, Extra, and OS fields of
+	// the gzip header rather than leaving them to the gzip.Writer defaults,
+	// so identical input gives a byte for byte identical archive across Go
+	// versions and platforms; LatestModTime still replaces the ModTime
+	GzipHeader *gzip.Header
+
+	// HardLinks writes a file that is a hard link to an already archived
+	// file as a link entry to the first name instead of its body again, so
+	// the linkage is restored on extraction; it has no effect on Windows or
+	// with ContentAddressed
+	HardLinks bool
+
+	// AccessTimes writes every entry in the PAX format, which unlike the
+	// default USTAR format carries the access and change time of each file
+	// next to its modification time; UntarWith restores the access time
+	AccessTimes bool
+
+	// PreserveTimes records the actual modification, access, and change
+	// time of every entry as found on disk, ignoring any times set in opt,
+	// in the PAX format so none is collapsed into another; UntarWith
+	// restores the access and modification time
+	PreserveTimes bool
+
+	// Order is called with every path found walking src, in a pre-pass, and
+	// the entries are written in the order of the paths it returns, such as
+	// to put a bootstrap file first for streaming consumers; any path left
+	// out is not archived. It takes precedence over Sorted and SortEntries.
+	Order func(paths []string) []string
+
+	// BlockSize writes the output to the writers in records of exactly this
+	// many bytes, padding the last record with zeros, for tape drives and
+	// other devices that need fixed size records; zero writes as produced
+	BlockSize int
+
+	// ChunkSize splits each file larger than this many bytes into parts of
+	// at most this size, named <name>.part0001 and so on, ahead of which an
+	// index entry named <name>.parts lists the parts for reassembly, which
+	// UntarOptions.Reassemble does; Workers is ignored with chunking, and
+	// a file that HardLinks or Dedup would link to a chunked one is written
+	// in full, since no entry carries the original name
+	ChunkSize int64
+
+	// Uid and Gid, when not nil, replace the numeric owner and group of
+	// every entry, such as 0 and 0 for root owned, ownership neutral
+	// archives next to the Uname and Gname of opt
+	Uid, Gid *int
+
+	// Dictionary deflates the archive against this preset dictionary, such
+	// as a sample of the typical content, which greatly improves the ratio
+	// for many small similar files. The gzip format has no field for it, so
+	// the archive must be read through NewDictReader with the same bytes;
+	// GzipHeader and LatestModTime are ignored. It stands in for a zstd
+	// dictionary, which is not offered since zstd would be the first
+	// dependency of the module; register a zstd reader with
+	// RegisterDecompressor to read such archives made elsewhere.
+	Dictionary []byte
+
+	// Events receives a JSON line of the name, size, and mode of each entry
+	// as it is added, such as {"name":"a.txt","size":5,"mode":420}, for an
+	// audit trail in log pipelines next to the archive itself
+	Events io.Writer
+}
+
+// inodeKey identifies a file by device and inode for HardLinks
+type inodeKey struct {
+	dev, ino uint64
+}
+
+// TarWith is Tar with the extended settings in o applied; pass o as nil to
+// use the defaults
+func TarWith(src string, opt *tar.Header, o *TarOptions, writers ...io.Writer) error {
 
-	info, err := os.Stat(src)
+	// the output layers over a writer that duplicates its writes
+	w, finish, err := o.layers(io.MultiWriter(writers...), nil, src)
 	if err != nil {
 		return err
 	}
 
-	// create a writer that duplicates its writes
-	mw := io.MultiWriter(writers...)
+	err = tarTo(w, opt, o, src)
+	if ferr := finish(); err == nil {
+		err = ferr
+	}
 
-	gzw := gzip.NewWriter(mw) // compression
-	defer gzw.Close()
+	return err
+}
 
-	tw := tar.NewWriter(gzw) // tarball
-	defer tw.Close()
+// layers returns w beneath the layers the options ask for, which are the
+// BlockSize records and then a gzip stream, deflated against Dictionary
+// when set, unless Store; a gzip.Writer is reused from pool when not nil.
+// The returned func finishes the layers, leaving w open.
+func (o *TarOptions) layers(w io.Writer, pool *sync.Pool, srcs ...string) (io.Writer, func() error, error) {
 
-	// path is a single file not a directory
-	if !info.IsDir() {
+	if o == nil {
+		o = &TarOptions{}
+	}
 
-		// fail when mode bits are set; no executables
-		if !info.Mode().IsRegular() {
-			return nil
+	var closers []func() error
+	finish := func() error {
+		var err error
+		for i := len(closers) - 1; i >= 0; i-- {
+			if cerr := closers[i](); err == nil {
+				err = cerr
+			}
 		}
-
-		// write a header to the tarball archive
-		tw.WriteHeader(&tar.Header{
-			Name:  filepath.Base(src),
-			Size:  int64(info.Size()),
-			Uname: opt.Uname,
-			Gname: opt.Gname,
-			Mode:  opt.Mode,
-		})
-
-		// copy the file source
-		f, _ := os.Open(src)
-		_, err = io.Copy(tw, f)
-		f.Close()
-
 		return err
 	}
 
-	// walk path and all sub directory tree
-	return filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+	// fixed size records
+	if o.BlockSize > 0 {
+		bw := newBlockWriter(w, o.BlockSize)
+		closers = append(closers, bw.Close)
+		w = bw
+	}
+
+	switch {
 
-		// walk failed, so we fail too
+	// plain tar without the compression layer
+	case o.Store:
+
+	// compression against a preset dictionary
+	case o.Dictionary != nil:
+		dw, err := newDictWriter(w, o.Dictionary)
 		if err != nil {
+			return nil, nil, err
+		}
+		closers = append(closers, dw.Close)
+		w = dw
+
+	default:
+		var gzw *gzip.Writer
+		if pool != nil {
+			gzw, _ = pool.Get().(*gzip.Writer)
+		}
+		if gzw != nil {
+			gzw.Reset(w)
+		} else {
+			gzw = gzip.NewWriter(w) // compression
+		}
+		closers = append(closers, func() error {
+			err := gzw.Close()
+			if pool != nil {
+				// release the destination before the writer goes back
+				gzw.Reset(ioutil.Discard)
+				pool.Put(gzw)
+			}
 			return err
+		})
+		if err := o.gzipHeader(gzw, srcs...); err != nil {
+			finish()
+			return nil, nil, err
 		}
+		w = gzw
+	}
 
-		// fail when mode bits are set, no executables
-		if !info.Mode().IsRegular() {
-			return nil
+	return w, finish, nil
+}
+
+// gzipHeader sets the gzip header fields requested by the options for the
+// archive of srcs
+func (o *TarOptions) gzipHeader(gzw *gzip.Writer, srcs ...string) error {
+
+	if o == nil {
+		return nil
+	}
+
+	if h := o.GzipHeader; h != nil {
+		gzw.Header = gzip.Header{
+			Name:    h.Name,
+			Comment: h.Comment,
+			ModTime: h.ModTime,
+			Extra:   h.Extra,
+			OS:      h.OS,
 		}
+	}
+
+	if !o.LatestModTime {
+		return nil
+	}
 
-		// create a new file header for the archive
-		header, err := tar.FileInfoHeader(info, info.Name())
+	// pre-pass for the newest modification time in the tree
+	for _, src := range srcs {
+		err := filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() && info.ModTime().After(gzw.Header.ModTime) {
+				gzw.Header.ModTime = info.ModTime()
+			}
+			return nil
+		})
 		if err != nil {
 			return err
 		}
+	}
 
-		header.Gname = opt.Gname // set group
-		header.Uname = opt.Uname // set user
-		header.Mode = opt.Mode   // set permissions
+	return nil
+}
 
-		// use updated modifcation time
-		if !opt.ModTime.IsZero() {
-			header.AccessTime = opt.ModTime
-			header.ChangeTime = opt.ModTime
-			header.ModTime = opt.ModTime
-		}
+// WalkInto takes a caller supplied tar writer and writes the file, or each
+// file found walking the directory, at src into it using the same header
+// logic as Tar. No gzip or tar layer is created and tw is left open, so any
+// compressor, or none at all, can sit beneath it.
+func WalkInto(tw *tar.Writer, src string, opt *tar.Header) error {
+	return walkTree(tw, src, opt, nil)
+}
 
-		// utilize an updated name for the correct path when untaring
-		header.Name = strings.TrimPrefix(strings.Replace(file, src, "", -1), string(filepath.Separator))
+// tarTo writes the tarball of srcs to w, sharing one walk so options such
+// as Dedup span all of them, and closes the tar writer, leaving w open for
+// the caller
+func tarTo(w io.Writer, opt *tar.Header, o *TarOptions, srcs ...string) error {
 
-		// write the file header
-		if err := tw.WriteHeader(header); err != nil {
-			return err
+	if o != nil && o.EmbedChecksums {
+		if o.BodyTransform != nil {
+			return errors.New("tgz: EmbedChecksums can not be combined with BodyTransform")
 		}
+		// the checksums lead the archive rather than finish it as well
+		embed := *o
+		embed.WithChecksums = false
+		o = &embed
+	}
 
-		// copy the file source
-		f, _ := os.Open(file)
-		_, err = io.Copy(tw, f)
-		f.Close()
+	tw := tar.NewWriter(w) // tarball
+	err := o.globalHeader(tw)
+	if err == nil && o != nil && o.EmbedChecksums {
+		err = embedChecksums(tw, opt, o, srcs...)
+	}
+	if err == nil {
+		_, err = walkEntries(tw, opt, o, srcs...)
+	}
+	if cerr := tw.Close(); err == nil {
+		err = cerr
+	}
 
-		return err
+	return err
+}
+
+// globalHeader writes the archive level PAXRecords, when there are any
+func (o *TarOptions) globalHeader(tw *tar.Writer) error {
+
+	if o == nil || len(o.PAXRecords) == 0 {
+		return nil
+	}
+
+	return tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		PAXRecords: o.PAXRecords,
 	})
 }
 
-// Untar takes a destination path and an io.Reader that loops over the tarfile
-// contents and will create the file structure within the destination
-func Untar(dst string, r io.Reader) error {
+// embedChecksums writes the SHA256SUMS entry of the files at srcs, hashed
+// in a pre-pass that selects and names them the same as the archive does
+func embedChecksums(tw *tar.Writer, opt *tar.Header, o *TarOptions, srcs ...string) error {
+
+	pre := *o
+	pre.EmbedChecksums, pre.WithChecksums = false, true
+	pre.RequireEntries, pre.Workers = false, 0
+	pre.Events, pre.Skipped, pre.Locked = nil, nil, nil
 
-	gzr, err := gzip.NewReader(r)
+	sums, err := walkEntries(nil, opt, &pre, srcs...)
 	if err != nil {
 		return err
 	}
-	defer gzr.Close()
 
-	tr := tar.NewReader(gzr)
+	return writeEntry(tw, ApplyDefaults(opt), "SHA256SUMS", sums)
+}
 
-	for {
+// walkTree writes the file, or each file found walking the directory, at
+// src into the tar writer
+func walkTree(tw *tar.Writer, src string, opt *tar.Header, o *TarOptions) error {
+	_, err := walkEntries(tw, opt, o, src)
+	return err
+}
 
-		header, err := tr.Next()
-		switch {
-		case header == nil:
-			continue // what?! skip it
+// walkEntries is walkTree returning the SHA256SUMS lines of WithChecksums;
+// with a nil tw nothing is written, so only the checksums are computed
+func walkEntries(tw *tar.Writer, opt *tar.Header, o *TarOptions, srcs ...string) ([]byte, error) {
 
-		case err == io.EOF:
+	// apply default options when nil is passed
+	if o == nil {
+		o = &TarOptions{}
+	}
+
+	// apply default options when nil or empty
+	opt = ApplyDefaults(opt)
+
+	// content hash to the first archived name for dedup
+	seen := make(map[string]string)
+
+	// original path to content hash for the content addressed manifest
+	manifest := make(map[string]string)
+
+	// inode to the first archived name for HardLinks
+	links := make(map[inodeKey]string)
+
+	// names split into parts by ChunkSize, which a link can not point at
+	chunked := make(map[string]bool)
+
+	// the path of srcs being walked
+	var src string
+
+	// put writes the header followed by the body of file, when not empty
+	put := func(header *tar.Header, file string) error {
+		if tw == nil {
 			return nil
+		}
+		if file != "" && o.ChunkSize > 0 && header.Size > o.ChunkSize {
+			return writeChunks(tw, header, file, o.ChunkSize)
+		}
+		if err := tw.WriteHeader(header); err != nil || file == "" {
+			return err
+		}
+		if header.Size < o.SmallFileBytes {
+			return copySmall(tw, file, header.Size)
+		}
+		return copyFile(tw, file, header.Size)
+	}
 
-		case err != nil:
+	// read the bodies ahead of the serial tar writer
+	var p *prefetcher
+	if o.Workers > 1 && o.BodyTransform == nil && o.ChunkSize == 0 {
+		p = newPrefetcher(tw, o.Workers)
+		put = p.put
+	}
+
+	// count the entries written and record their checksums
+	var entries int
+	var sums bytes.Buffer
+	hexes := make(map[string]string)
+	write := put
+	put = func(header *tar.Header, file string) error {
+		entries++
+		if err := o.event(header); err != nil {
 			return err
 		}
+		if o.WithChecksums {
+			var sum string
+			switch header.Typeflag {
+			case tar.TypeReg:
+				var err error
+				if sum, err = hashFile(file); err != nil {
+					return err
+				}
+			case tar.TypeLink:
+				sum = hexes[header.Linkname]
+			}
+			if sum != "" {
+				hexes[header.Name] = sum
+				fmt.Fprintf(&sums, "%s  %s\n", sum, header.Name)
+			}
+		}
+		return write(header, file)
+	}
 
-		target := filepath.Join(dst, header.Name)
+	// write the parent directories of every entry ahead of it
+	if o.DirsFirst {
+		emitted := make(map[string]bool)
+		child := put
+		put = func(header *tar.Header, file string) error {
 
-		switch header.Typeflag {
-		case tar.TypeDir:
+			name := strings.TrimSuffix(filepath.ToSlash(header.Name), "/")
+			if header.Typeflag == tar.TypeDir && emitted[name] {
+				return nil
+			}
 
-			if _, err := os.Stat(target); err != nil {
-				if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
+			for _, dir := range newParents(emitted, name) {
+				var h *tar.Header
+				if info, err := os.Stat(filepath.Join(src, filepath.FromSlash(dir))); err == nil && info.IsDir() {
+					if h, err = o.dirHeader(info, dir, opt); err != nil {
+						return err
+					}
+				} else {
+					// a directory of the archive alone, such as blobs/
+					h = o.archiveDir(dir, opt)
+				}
+				if err := child(h, ""); err != nil {
 					return err
 				}
 			}
 
-		case tar.TypeReg:
+			if header.Typeflag == tar.TypeDir {
+				emitted[name] = true
+			}
+			return child(header, file)
+		}
+	}
+
+	// walk each path and all sub directory tree
+	walk := func() error {
+
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+
+		// the device of src for OneFileSystem
+		dev, hasDev := device(info)
+
+		walkFn := filepath.Walk
+		switch {
+		case o.Order != nil:
+			walkFn = func(root string, fn filepath.WalkFunc) error {
+				return orderedWalk(root, o.Order, fn)
+			}
+		case o.SortEntries:
+			walkFn = func(root string, fn filepath.WalkFunc) error {
+				return orderedWalk(root, sortPaths, fn)
+			}
+		case o.Sorted:
+			walkFn = sortedWalk
+		}
+
+		// a single file, followed when it is a symlink
+		if !info.IsDir() {
+			walkFn = func(root string, fn filepath.WalkFunc) error {
+				return fn(root, info, nil)
+			}
+		}
+
+		return walkFn(src, func(file string, info os.FileInfo, err error) error {
 
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, os.FileMode(header.Mode))
+			// walk failed, so we fail too
 			if err != nil {
 				return err
 			}
-			if _, err := io.Copy(f, tr); err != nil {
+
+			// utilize an updated name for the correct path when untaring
+			name := strings.TrimPrefix(strings.Replace(file, src, "", -1), string(filepath.Separator))
+
+			// stay on the device of src
+			if info.IsDir() && o.OneFileSystem && hasDev {
+				if d, ok := device(info); ok && d != dev {
+					return filepath.SkipDir
+				}
+			}
+
+			// directory entries keep their own mode unless DirMode is set
+			if info.IsDir() {
+				if !o.Dirs || name == "" {
+					return nil
+				}
+				header, err := o.dirHeader(info, name, opt)
+				if err != nil {
+					return err
+				}
+				return put(header, "")
+			}
+
+			// keep a symbolic link as a link to its target
+			if info.Mode()&os.ModeSymlink != 0 && o.Symlinks {
+				link, err := os.Readlink(file)
+				if err != nil {
+					return err
+				}
+				if o.RelativeSymlinks {
+					if link, err = relLink(src, file, link); err != nil {
+						return err
+					}
+				}
+				header, err := tar.FileInfoHeader(info, link)
+				if err != nil {
+					return err
+				}
+				setHeader(header, opt)
+				o.owner(header)
+				o.times(header, info)
+				header.Name = filepath.ToSlash(name)
+				return put(header, "")
+			}
+
+			// fail when mode bits are set, no executables
+			if !info.Mode().IsRegular() || o.locked(file) {
+				o.skipped(file, info)
+				return nil
+			}
+			if o.SkipEmpty && info.Size() == 0 {
+				return nil
+			}
+
+			// create a new file header for the archive; a single file src is
+			// named by opt when set, else after the file
+			var header *tar.Header
+			if name == "" {
+				header = &tar.Header{
+					Typeflag: tar.TypeReg,
+					Name:     opt.Name,
+					Size:     int64(info.Size()),
+					Uname:    opt.Uname,
+					Gname:    opt.Gname,
+					Mode:     opt.Mode,
+				}
+				if header.Name == "" {
+					header.Name = filepath.Base(file)
+				}
+			} else {
+				if header, err = tar.FileInfoHeader(info, info.Name()); err != nil {
+					return err
+				}
+				setHeader(header, opt)
+				header.Name = name
+			}
+			o.owner(header)
+			o.times(header, info)
+
+			if err := o.records(header, file, info); err != nil {
 				return err
 			}
-			f.Close()
+
+			// reference a hard link to a file that was already archived
+			if o.HardLinks && !o.ContentAddressed {
+				if id, nlink, ok := inode(info); ok && nlink > 1 {
+					if first, ok := links[id]; ok && !chunked[first] {
+						header.Typeflag = tar.TypeLink
+						header.Linkname = first
+						header.Size = 0
+						return put(header, "")
+					}
+					links[id] = header.Name
+				}
+			}
+
+			// hash the body when the content decides how it is stored
+			var sum string
+			if o.Dedup || o.ContentAddressed {
+				if sum, err = hashFile(file); err != nil {
+					return err
+				}
+			}
+
+			// store the body under its hash, only once
+			if o.ContentAddressed {
+				manifest[header.Name] = sum
+				if _, ok := seen[sum]; ok {
+					return nil
+				}
+				header.Name = "blobs/" + sum
+				seen[sum] = header.Name
+			}
+
+			// reference an identical body that was already archived
+			if o.Dedup && !o.ContentAddressed {
+				if first, ok := seen[sum]; ok && !chunked[first] {
+					header.Typeflag = tar.TypeLink
+					header.Linkname = first
+					header.Size = 0
+					return put(header, "")
+				}
+				seen[sum] = header.Name
+			}
+
+			// spool the transformed body to learn its size
+			if o.BodyTransform != nil {
+				tmp, size, err := transform(o.BodyTransform, header.Name, file)
+				if err != nil {
+					return err
+				}
+				defer os.Remove(tmp)
+				file, header.Size = tmp, size
+			}
+
+			// write the file header and copy the file source
+			if o.ChunkSize > 0 && header.Size > o.ChunkSize {
+				chunked[header.Name] = true
+			}
+			return put(header, file)
+		})
+	}
+
+	var err error
+	for _, src = range srcs {
+		if err = walk(); err != nil {
+			break
+		}
+	}
+	if p != nil {
+		if perr := p.close(); err == nil {
+			err = perr
+		}
+	}
+	if err == nil && entries == 0 && o.RequireEntries {
+		err = ErrEmpty
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if tw == nil {
+		return sums.Bytes(), nil
+	}
+
+	// finish with the manifest of path to content hash
+	if o.ContentAddressed {
+		b, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return nil, err
 		}
+		if err := writeEntry(tw, opt, "manifest.json", b); err != nil {
+			return nil, err
+		}
+	}
+
+	// and the checksums as the last member
+	if o.WithChecksums {
+		return nil, writeEntry(tw, opt, "SHA256SUMS", sums.Bytes())
+	}
+
+	return nil, nil
+}
+
+// relLink returns the target of the link at file relative to the link,
+// failing with ErrUnsafePath when it resolves outside of root
+func relLink(root, file, link string) (string, error) {
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return "", err
+	}
+
+	target := link
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(dir, target)
+	}
+	if rel, err := filepath.Rel(root, target); err != nil || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %q links to %q", ErrUnsafePath, file, link)
 	}
+
+	rel, err := filepath.Rel(dir, target)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.ToSlash(rel), nil
+}
+
+// skipped reports a file that is not regular to the Skipped callback
+func (o *TarOptions) skipped(file string, info os.FileInfo) {
+	if o.Skipped != nil && !info.Mode().IsRegular() {
+		o.Skipped(file)
+	}
+}
+
+// locked reports whether file is held open by another process and is to
+// be skipped with SkipLocked; the file is probed before its header is
+// written since the body is only opened after
+func (o *TarOptions) locked(file string) bool {
+
+	if !o.SkipLocked {
+		return false
+	}
+
+	f, err := os.Open(file)
+	if err == nil {
+		f.Close()
+		return false
+	}
+	if !isLocked(err) {
+		return false
+	}
+	if o.Locked != nil {
+		o.Locked(file, err)
+	}
+
+	return true
+}
+
+// writeEntry writes a synthesized file entry holding b
+func writeEntry(tw *tar.Writer, opt *tar.Header, name string, b []byte) error {
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Size:    int64(len(b)),
+		Uname:   opt.Uname,
+		Gname:   opt.Gname,
+		Mode:    opt.Mode,
+		ModTime: opt.ModTime,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(b)
+
+	return err
+}
+
+// dirHeader returns the entry for the directory at name, which keeps its
+// own permissions rather than opt.Mode unless DirMode is set
+func (o *TarOptions) dirHeader(info os.FileInfo, name string, opt *tar.Header) (*tar.Header, error) {
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return nil, err
+	}
+	mode := header.Mode
+	setHeader(header, opt)
+	o.owner(header)
+	o.times(header, info)
+	header.Name = filepath.ToSlash(name) + "/"
+	header.Mode = mode
+	if o.DirMode != 0 {
+		header.Mode = o.DirMode
+	}
+
+	return header, nil
+}
+
+// event writes the Events line for header, when Events is set
+func (o *TarOptions) event(header *tar.Header) error {
+
+	if o.Events == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(struct {
+		Name string `json:"name"`
+		Size int64  `json:"size"`
+		Mode int64  `json:"mode"`
+	}{header.Name, header.Size, header.Mode})
+	if err != nil {
+		return err
+	}
+	_, err = o.Events.Write(append(b, '\n'))
+
+	return err
+}
+
+// archiveDir returns the entry for a directory at name that exists only in
+// the archive, with no directory on disk behind it
+func (o *TarOptions) archiveDir(name string, opt *tar.Header) *tar.Header {
+
+	header := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0755,
+		Uname:    opt.Uname,
+		Gname:    opt.Gname,
+		ModTime:  opt.ModTime,
+	}
+	o.owner(header)
+	if o.DirMode != 0 {
+		header.Mode = o.DirMode
+	}
+
+	return header
+}
+
+// newParents returns the directories above the slash separated name that
+// are not yet in written, outermost first, and adds them to written
+func newParents(written map[string]bool, name string) []string {
+
+	var dirs []string
+	for dir := path.Dir(name); dir != "." && dir != "/" && !written[dir]; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	for _, dir := range dirs {
+		written[dir] = true
+	}
+
+	return dirs
+}
+
+// owner applies the numeric Uid and Gid, when set, to header
+func (o *TarOptions) owner(header *tar.Header) {
+	if o.Uid != nil {
+		header.Uid = *o.Uid
+	}
+	if o.Gid != nil {
+		header.Gid = *o.Gid
+	}
+}
+
+// times replaces the times of header, when PreserveTimes is set, with
+// those reported for the file by stat
+func (o *TarOptions) times(header *tar.Header, info os.FileInfo) {
+
+	if !o.PreserveTimes {
+		return
+	}
+
+	// FileInfoHeader reads atime and ctime from syscall.Stat_t where available
+	if fi, err := tar.FileInfoHeader(info, ""); err == nil {
+		header.ModTime = fi.ModTime
+		header.AccessTime = fi.AccessTime
+		header.ChangeTime = fi.ChangeTime
+	}
+	header.Format = tar.FormatPAX
+}
+
+// records adds the PAX records, and sets the format, requested by the
+// options for file
+func (o *TarOptions) records(header *tar.Header, file string, info os.FileInfo) error {
+
+	if o.AccessTimes {
+		header.Format = tar.FormatPAX
+	}
+
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+
+	if o.PreserveCaps {
+		caps, err := getCaps(file)
+		if err != nil {
+			return err
+		}
+		if len(caps) > 0 {
+			header.PAXRecords[paxCaps] = string(caps)
+		}
+	}
+
+	if o.BirthTime {
+		if t, ok := birthTime(info); ok {
+			header.PAXRecords[paxBirthTime] = formatPAXTime(t)
+		}
+	}
+
+	if o.FileFlags {
+		if flags := getFileFlags(file); flags != "" {
+			header.PAXRecords[paxFileFlags] = flags
+		}
+	}
+
+	return nil
+}
+
+// setHeader applies the user, group, permissions, and any modification,
+// access, or change time of opt to a header created from a file; each time
+// not set in opt keeps the value of the file
+func setHeader(header *tar.Header, opt *tar.Header) {
+
+	header.Gname = opt.Gname // set group
+	header.Uname = opt.Uname // set user
+	header.Mode = opt.Mode   // set permissions
+
+	// use updated times
+	if !opt.ModTime.IsZero() {
+		header.ModTime = opt.ModTime
+	}
+	if !opt.AccessTime.IsZero() {
+		header.AccessTime = opt.AccessTime
+	}
+	if !opt.ChangeTime.IsZero() {
+		header.ChangeTime = opt.ChangeTime
+	}
+}
+
+// transform passes the content of file through fn into a temporary file and
+// returns its path and size; the caller removes the file
+func transform(fn func(string, io.Reader) (io.Reader, error), name, file string) (string, int64, error) {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	r, err := fn(name, f)
+	if err != nil {
+		return "", 0, err
+	}
+
+	tmp, err := ioutil.TempFile("", "tgz-")
+	if err != nil {
+		return "", 0, err
+	}
+	size, err := io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+
+	return tmp.Name(), size, nil
+}
+
+// hashFile returns the hex encoded sha256 of the file content
+func hashFile(file string) (string, error) {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyFile opens file and copies exactly size bytes into the writer; a
+// tar entry must match its declared size so a file that grows or shrinks
+// between the stat and the copy returns ErrChanged rather than corrupting
+// the archive
+func copyFile(w io.Writer, file string, size int64) error {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return copyBody(w, f, file, size)
+}
+
+// bufPool holds the buffers used to read small files whole
+var bufPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// copySmall reads the file into a pooled buffer and writes it in one call
+func copySmall(w io.Writer, file string, size int64) error {
+
+	buf := bufPool.Get().(*bytes.Buffer)
+	defer bufPool.Put(buf)
+	buf.Reset()
+
+	if err := copyFile(buf, file, size); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+
+	return err
+}
+
+// copyBody copies exactly size bytes from r into the writer, returning
+// ErrChanged when r holds fewer or more bytes
+func copyBody(w io.Writer, r io.Reader, file string, size int64) error {
+
+	n, err := io.CopyN(w, r, size)
+	switch {
+	case err == io.EOF:
+		return fmt.Errorf("%w: %s: shrank to %d of %d bytes", ErrChanged, file, n, size)
+	case err != nil:
+		return err
+	}
+
+	// any byte remaining means the file grew after the stat
+	if n, _ := io.ReadFull(r, make([]byte, 1)); n > 0 {
+		return fmt.Errorf("%w: %s: grew beyond %d bytes", ErrChanged, file, size)
+	}
+
+	return nil
+}
+
+// Untar takes a destination path and an io.Reader that loops over the tarfile
+// contents and will create the file structure within the destination. A plain
+// tar without the gzip layer is detected by its missing magic bytes.
+func Untar(dst string, r io.Reader) error {
+	return UntarWith(dst, r, nil)
+}
+
+// UntarInspect is Untar calling inspect with each header before the entry
+// is extracted; returning ErrSkip skips the entry and any other error
+// aborts the extraction with that error
+func UntarInspect(dst string, inspect func(*tar.Header) error, r io.Reader) error {
+	return UntarWith(dst, r, &UntarOptions{Inspect: inspect})
+}
+
+// UntarMatch is Untar extracting only the entries whose name matches the
+// path.Match pattern, such as "*.conf" or "etc/*/*.conf"; a pattern with no
+// slash is matched against the base name at any depth. The other entries are
+// read past without being written.
+func UntarMatch(dst, pattern string, r io.Reader) error {
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+
+	return UntarInspect(dst, func(header *tar.Header) error {
+		name := strings.TrimSuffix(header.Name, "/")
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(name)
+		}
+		if ok, _ := path.Match(pattern, name); !ok {
+			return ErrSkip
+		}
+		return nil
+	}, r)
+}
+
+// UntarHashes is Untar returning the sha256 of the body of every regular
+// file extracted, keyed by entry name, computed while the files are written
+func UntarHashes(dst string, r io.Reader) (map[string][]byte, error) {
+
+	sums := make(map[string][]byte)
+	err := UntarWith(dst, r, &UntarOptions{Hashed: func(name string, sum []byte) {
+		sums[name] = sum
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	return sums, nil
+}
+
+// UntarOffset is Untar for an archive embedded after skip bytes of some
+// other framing, such as a fixed size proprietary header; the skipped bytes
+// are sought past on an io.Seeker and read and discarded otherwise
+func UntarOffset(dst string, r io.Reader, skip int64) error {
+
+	if rs, ok := r.(io.Seeker); ok {
+		if _, err := rs.Seek(skip, io.SeekCurrent); err != nil {
+			return err
+		}
+	} else if _, err := io.CopyN(ioutil.Discard, r, skip); err != nil {
+		return err
+	}
+
+	return Untar(dst, r)
+}
+
+// UntarOptions are the extended settings for UntarWith; the zero value
+// extracts exactly the same as Untar
+type UntarOptions struct {
+
+	// Force makes read-only files and directories that block extraction
+	// writable long enough to replace the file, then restores their modes
+	Force bool
+
+	// MaxFileBytes rejects any entry larger than this many bytes before it
+	// is extracted; zero means no limit
+	MaxFileBytes int64
+
+	// PreserveCaps restores the Linux security.capability xattr recorded by
+	// TarOptions.PreserveCaps; this requires CAP_SETFCAP
+	PreserveCaps bool
+
+	// TextConvert rewrites the line endings of matching text entries as
+	// they are extracted
+	TextConvert *TextConvert
+
+	// BirthTime restores the file creation time recorded by
+	// TarOptions.BirthTime where the platform allows setting it, and is
+	// silently skipped elsewhere
+	BirthTime bool
+
+	// Strict returns ErrUnsupportedType for any entry other than regular
+	// files, directories, hard or symbolic links, and the nodes restored
+	// with RestoreSpecial rather than skipping it
+	Strict bool
+
+	// ClampPaths rewrites entry names so that absolute paths and leading ..
+	// elements are stripped and every entry lands inside the destination,
+	// rather than returning ErrUnsafePath
+	ClampPaths bool
+
+	// SpecialBits restores the setuid, setgid, and sticky bits, which are
+	// otherwise dropped, with an explicit chmod once the entry is written
+	SpecialBits bool
+
+	// FileFlags restores the Linux inode flags recorded by
+	// TarOptions.FileFlags as the last step for each file; this is best
+	// effort and skipped where the flags are not supported or permitted
+	FileFlags bool
+
+	// RejectDuplicates returns ErrDuplicate, naming the entry, when an entry
+	// name repeats instead of letting the later entry overwrite the earlier;
+	// names are compared cleaned, so a.txt and ./a.txt are the same entry
+	RejectDuplicates bool
+
+	// ForceMode, when not zero, is the permission set on every extracted
+	// file and directory in place of the recorded mode, so an untrusted
+	// archive cannot choose its own permissions. Directories also get the
+	// search bit wherever ForceMode grants read so they stay traversable.
+	ForceMode os.FileMode
+
+	// MaxDepth rejects any entry whose name has more than this many path
+	// components with ErrTooDeep; zero means no limit
+	MaxDepth int
+
+	// Inspect is called with each header before the entry is extracted to
+	// audit or enforce a policy; returning ErrSkip skips the entry and any
+	// other error aborts the extraction
+	Inspect func(*tar.Header) error
+
+	// CleanupOnError removes every file and directory the extraction
+	// created, in reverse order, when it fails part way, so a failed
+	// install leaves no partial tree behind. Files that already existed and
+	// were overwritten keep their new content.
+	CleanupOnError bool
+
+	// RestoreSpecial recreates named pipes on Linux, macOS, and the BSDs,
+	// and character and block devices, which need root, on Linux; these are
+	// otherwise skipped, as is a node without the privilege to create it
+	RestoreSpecial bool
+
+	// VerifyDirs stats every directory entry once extraction finishes and
+	// returns ErrMissingDir listing any that is missing or not a directory,
+	// such as where a file and a directory share a name
+	VerifyDirs bool
+
+	// Reassemble joins the parts of each file split by TarOptions.ChunkSize
+	// back into the original file rather than extracting the index and the
+	// parts as files of their own
+	Reassemble bool
+
+	// Hashed is called with the name and sha256 of the body of each regular
+	// file entry, as read from the archive, once it is extracted, so the
+	// manifest of an extraction is built without reading the files back
+	Hashed func(name string, sum []byte)
+
+	// MapOwner restores the ownership of each entry, other than hard links,
+	// as the uid and gid it returns for those recorded in the archive, such
+	// as to remap 1000 to the current user on another host; returning them
+	// unchanged restores the recorded owner and -1 keeps the current one.
+	// Changing owners generally needs root, and it has no effect on Windows.
+	MapOwner func(uid, gid int) (int, int)
+
+	// Flatten extracts every entry directly into dst under the base of its
+	// name and skips the directory entries; a later entry of the same base
+	// name replaces an earlier one, unless RejectDuplicates is set. Relative
+	// symlinks are pointed at the base of their target, and skipped when
+	// that target is a directory such as . or ..
+	Flatten bool
+}
+
+// UntarWith is Untar with the extended settings in o applied; pass o as nil
+// to use the defaults
+func UntarWith(dst string, r io.Reader, o *UntarOptions) error {
+
+	// apply default options when nil is passed
+	if o == nil {
+		o = &UntarOptions{}
+	}
+
+	if !o.CleanupOnError {
+		return o.untar(dst, r, nil)
+	}
+
+	// undo what was created, newest first
+	var created []string
+	err := o.untar(dst, r, &created)
+	if err != nil {
+		for i := len(created) - 1; i >= 0; i-- {
+			os.Remove(created[i])
+		}
+	}
+
+	return err
+}
+
+// untar extracts the archive in r to dst, adding the paths it creates to
+// created when not nil
+func (o *UntarOptions) untar(dst string, r io.Reader, created *[]string) error {
+
+	ar, err := openArchive(r)
+	if err != nil {
+		return err
+	}
+	defer ar.Close()
+
+	tr := tar.NewReader(ar)
+
+	// entry names already extracted for RejectDuplicates
+	seen := make(map[string]bool)
+
+	// directory entries to set the times of and check with VerifyDirs
+	var dirs []*tar.Header
+
+	// body of the current entry, the parts of a file with Reassemble
+	var body io.Reader
+
+	// name of the previous entry, to place a corrupt header
+	var prev string
+
+	for {
+
+		// parts left unread when a reassembled file was skipped
+		if pr, ok := body.(*partsReader); ok {
+			if _, err := io.Copy(ioutil.Discard, pr); err != nil {
+				return fmt.Errorf("tgz: extract %q: %w", prev, err)
+			}
+		}
+
+		header, err := tr.Next()
+		switch {
+		case err == io.EOF:
+			if err := dirTimes(dst, dirs); err != nil {
+				return err
+			}
+			if o.VerifyDirs {
+				return verifyDirs(dst, dirs)
+			}
+			return nil
+
+		case err != nil && prev != "":
+			return fmt.Errorf("tgz: read header after %q: %w", prev, err)
+
+		case err != nil:
+			return err
+
+		case header == nil:
+			continue // what?! skip it
+		}
+		prev = header.Name
+
+		body = tr
+		if _, ok := header.PAXRecords[paxParts]; ok && o.Reassemble {
+			if header, body, err = reassemble(header, tr); err != nil {
+				return fmt.Errorf("tgz: extract %q: %w", prev, err)
+			}
+			prev = header.Name
+		}
+
+		if o.ClampPaths {
+			header.Name = clampName(header.Name)
+			if header.Typeflag == tar.TypeLink {
+				header.Linkname = clampName(header.Linkname)
+			}
+			if header.Name == "" {
+				continue // the destination itself
+			}
+			if header.Typeflag == tar.TypeSymlink && validLink(header) != nil {
+				continue // a symlink can not be clamped, so skip it
+			}
+		}
+
+		if o.Flatten {
+			if header.Typeflag == tar.TypeDir {
+				continue
+			}
+			header.Name = path.Base(strings.TrimSuffix(header.Name, "/"))
+			switch header.Typeflag {
+			case tar.TypeLink:
+				header.Linkname = path.Base(header.Linkname)
+			case tar.TypeSymlink:
+				if !path.IsAbs(header.Linkname) {
+					// the target now sits beside the link
+					header.Linkname = path.Base(path.Clean(header.Linkname))
+					if header.Linkname == "." || header.Linkname == ".." {
+						continue // a link to a directory, which is not extracted
+					}
+				}
+			}
+			if header.Name == "." || header.Name == "/" {
+				continue // the destination itself
+			}
+		}
+
+		if o.Inspect != nil {
+			switch err := o.Inspect(header); {
+			case err == ErrSkip:
+				continue
+			case err != nil:
+				return err
+			}
+		}
+
+		if err := validName(header.Name); err != nil {
+			return err
+		}
+		if o.RejectDuplicates {
+			name := path.Clean(filepath.ToSlash(header.Name))
+			if seen[name] {
+				return fmt.Errorf("%w: %q", ErrDuplicate, header.Name)
+			}
+			seen[name] = true
+		}
+		if err := o.validSize(header); err != nil {
+			return err
+		}
+		if err := o.validDepth(header); err != nil {
+			return err
+		}
+		if err := o.validType(header); err != nil {
+			return err
+		}
+		if created != nil {
+			*created = append(*created, missing(filepath.Join(dst, header.Name))...)
+		}
+		entry := body
+		var h hash.Hash
+		if o.Hashed != nil && header.Typeflag == tar.TypeReg {
+			h = sha256.New()
+			entry = io.TeeReader(body, h)
+		}
+		if err := o.extract(dst, header, entry); err != nil {
+			return fmt.Errorf("tgz: extract %q: %w", header.Name, err)
+		}
+		if h != nil {
+			if _, err := io.Copy(ioutil.Discard, entry); err != nil {
+				return fmt.Errorf("tgz: extract %q: %w", header.Name, err)
+			}
+			o.Hashed(header.Name, h.Sum(nil))
+		}
+		if header.Typeflag == tar.TypeDir {
+			dirs = append(dirs, header)
+		}
+	}
+}
+
+// extract writes the entry described by header within dst
+func (o *UntarOptions) extract(dst string, header *tar.Header, tr io.Reader) error {
+
+	target := filepath.Join(dst, header.Name)
+
+	// symlinks written by earlier entries must not carry this one outside
+	dir := filepath.Dir(target)
+	if header.Typeflag == tar.TypeDir {
+		dir = target
+	}
+	if err := resolveWithin(dst, dir); err != nil {
+		return err
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+
+		if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
+			return err
+		}
+		if err := o.chown(target, header); err != nil {
+			return err
+		}
+
+		// entries may arrive after files that already created the directory
+		// implicitly, so the recorded attributes are always applied, through
+		// the umask as for a new directory unless the exact mode is asked
+		// for; the times are set once the whole archive is extracted
+		mode := o.mode(header)
+		if !o.SpecialBits && o.ForceMode == 0 {
+			mode &^= umask()
+		}
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+
+	case tar.TypeLink:
+
+		if err := validName(header.Linkname); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := resolveWithin(dst, filepath.Dir(filepath.Join(dst, header.Linkname))); err != nil {
+			return err
+		}
+		if err := os.Link(filepath.Join(dst, header.Linkname), target); err != nil {
+			return err
+		}
+
+	case tar.TypeSymlink:
+
+		if err := validLink(header); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		// replace what a previous extraction left behind
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Symlink(header.Linkname, target); err != nil {
+			return err
+		}
+		if err := o.chown(target, header); err != nil {
+			return err
+		}
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+
+		if !o.RestoreSpecial {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		// replace what a previous extraction left behind
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		ok, err := mknod(target, header)
+		if err != nil || !ok {
+			return err
+		}
+		if err := o.chown(target, header); err != nil {
+			return err
+		}
+
+		// the node was created through the umask
+		if err := os.Chmod(target, o.mode(header)); err != nil {
+			return err
+		}
+		if err := chtimes(target, header); err != nil {
+			return err
+		}
+
+	case tar.TypeReg:
+
+		// archives without directory entries need the parents created
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		// replace a symlink rather than write through it
+		if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+
+		mode := os.FileMode(header.Mode)
+		if o.ForceMode != 0 {
+			mode = o.mode(header)
+		}
+		f, restore, err := openFile(target, mode, o.Force)
+		if err != nil {
+			return err
+		}
+		// read exactly the declared size, and no more than the cap even
+		// when a conversion grows the body
+		var body io.Reader = io.LimitReader(tr, header.Size)
+		if o.TextConvert != nil && o.TextConvert.match(header.Name) {
+			body = o.TextConvert.reader(body)
+		}
+		if o.MaxFileBytes > 0 {
+			body = io.LimitReader(body, o.MaxFileBytes+1)
+		}
+
+		n, err := io.Copy(f, body)
+		f.Close()
+		restore()
+		if err != nil {
+			return err
+		}
+		if o.MaxFileBytes > 0 && n > o.MaxFileBytes {
+			return fmt.Errorf("%w: wrote more than %d bytes", ErrTooLarge, o.MaxFileBytes)
+		}
+
+		// ahead of the capabilities and mode, which a change of owner clears
+		if err := o.chown(target, header); err != nil {
+			return err
+		}
+
+		if caps, ok := header.PAXRecords[paxCaps]; ok && o.PreserveCaps {
+			if err := setCaps(target, []byte(caps)); err != nil {
+				return err
+			}
+		}
+
+		// best effort, so failures are ignored
+		if v, ok := header.PAXRecords[paxBirthTime]; ok && o.BirthTime {
+			if t, err := parsePAXTime(v); err == nil {
+				setBirthTime(target, t)
+			}
+		}
+
+		// applied after the copy since writing clears setuid and setgid,
+		// and a replaced file keeps its old mode
+		if o.SpecialBits || o.ForceMode != 0 {
+			if err := os.Chmod(target, o.mode(header)); err != nil {
+				return err
+			}
+		}
+
+		if err := chtimes(target, header); err != nil {
+			return err
+		}
+
+		// last, since an immutable file refuses any further change
+		if flags, ok := header.PAXRecords[paxFileFlags]; ok && o.FileFlags {
+			setFileFlags(target, flags)
+		}
+	}
+
+	return nil
+}
+
+// chown sets the owner of target to the MapOwner mapping of the recorded
+// uid and gid, when MapOwner is set
+func (o *UntarOptions) chown(target string, header *tar.Header) error {
+
+	if o.MapOwner == nil {
+		return nil
+	}
+	uid, gid := o.MapOwner(header.Uid, header.Gid)
+
+	return lchown(target, uid, gid)
+}
+
+// dirTimes sets the recorded times of the directory entries, deepest first,
+// after their contents were written, since creating a child changes the
+// modification time of its directory
+func dirTimes(dst string, dirs []*tar.Header) error {
+
+	depth := func(name string) int { return strings.Count(path.Clean(name), "/") }
+
+	sorted := append([]*tar.Header(nil), dirs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return depth(sorted[i].Name) > depth(sorted[j].Name)
+	})
+
+	for _, header := range sorted {
+
+		// a later entry may have replaced the directory, which VerifyDirs
+		// reports
+		target := filepath.Join(dst, header.Name)
+		if info, err := os.Lstat(target); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := chtimes(target, header); err != nil {
+			return fmt.Errorf("tgz: extract %q: %w", header.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// chtimes sets the recorded modification time of target, and the access
+// time where the archive recorded one or else the modification time again
+func chtimes(target string, header *tar.Header) error {
+
+	if header.ModTime.IsZero() {
+		return nil
+	}
+
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = header.ModTime
+	}
+
+	return os.Chtimes(target, atime, header.ModTime)
+}
+
+// verifyDirs returns ErrMissingDir naming each of dirs that is not a
+// directory under dst
+func verifyDirs(dst string, dirs []*tar.Header) error {
+
+	var bad []string
+	for _, header := range dirs {
+		if info, err := os.Stat(filepath.Join(dst, header.Name)); err != nil || !info.IsDir() {
+			bad = append(bad, strconv.Quote(header.Name))
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("%w: %s", ErrMissingDir, strings.Join(bad, ", "))
+	}
+
+	return nil
+}
+
+// missing returns target and the parent directories above it that do not
+// exist yet, outermost first
+func missing(target string) []string {
+
+	var paths []string
+	for p := target; ; p = filepath.Dir(p) {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			break
+		}
+		paths = append([]string{p}, paths...)
+		if filepath.Dir(p) == p {
+			break
+		}
+	}
+
+	return paths
+}
+
+// mode converts the tar mode of header to the os.FileMode to apply, keeping
+// the setuid, setgid, and sticky bits only when SpecialBits is set, or the
+// ForceMode when one is set
+func (o *UntarOptions) mode(header *tar.Header) os.FileMode {
+
+	if o.ForceMode != 0 {
+		mode := o.ForceMode.Perm()
+		if header.Typeflag == tar.TypeDir {
+			mode |= (mode & 0444) >> 2
+		}
+		return mode
+	}
+
+	keep := os.ModePerm
+	if o.SpecialBits {
+		keep |= os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	}
+
+	return header.FileInfo().Mode() & keep
+}
+
+// openArchive returns the tar stream of r, reading through the registered
+// decompressor whose magic bytes lead the stream and reading r as a plain tar
+// otherwise. A plain tar io.ReadSeeker is returned still seekable so the tar
+// reader seeks past the bodies it skips.
+func openArchive(r io.Reader) (io.ReadCloser, error) {
+
+	n := magicLen()
+
+	if rs, ok := r.(io.ReadSeeker); ok {
+		pos, err := rs.Seek(0, io.SeekCurrent)
+		if err == nil {
+			head := make([]byte, n)
+			n, _ := io.ReadFull(rs, head)
+			if _, err := rs.Seek(pos, io.SeekStart); err != nil {
+				return nil, err
+			}
+			if factory := lookupDecompressor(head[:n]); factory != nil {
+				return factory(rs)
+			}
+			return nopSeekCloser{rs}, nil
+		}
+	}
+
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(n)
+	if factory := lookupDecompressor(head); factory != nil {
+		return factory(br)
+	}
+
+	return ioutil.NopCloser(br), nil
+}
+
+// nopSeekCloser adds a no-op Close to an io.ReadSeeker
+type nopSeekCloser struct{ io.ReadSeeker }
+
+func (nopSeekCloser) Close() error { return nil }
+
+// validSize rejects malformed sizes and those beyond the MaxFileBytes limit
+func (o *UntarOptions) validSize(header *tar.Header) error {
+
+	switch {
+	case header.Size < 0:
+		return fmt.Errorf("%w: %q declares %d bytes", ErrSize, header.Name, header.Size)
+
+	case o.MaxFileBytes > 0 && header.Size > o.MaxFileBytes:
+		return fmt.Errorf("%w: %q declares %d bytes, limit %d", ErrTooLarge, header.Name, header.Size, o.MaxFileBytes)
+	}
+
+	return nil
+}
+
+// validDepth rejects an entry name with more than MaxDepth path components
+func (o *UntarOptions) validDepth(header *tar.Header) error {
+
+	if o.MaxDepth <= 0 {
+		return nil
+	}
+	if depth := strings.Count(path.Clean(header.Name), "/") + 1; depth > o.MaxDepth {
+		return fmt.Errorf("%w: %q has %d components, limit %d", ErrTooDeep, header.Name, depth, o.MaxDepth)
+	}
+
+	return nil
+}
+
+// validType rejects unexpected entry types in strict mode
+func (o *UntarOptions) validType(header *tar.Header) error {
+
+	if !o.Strict {
+		return nil
+	}
+
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeDir, tar.TypeLink, tar.TypeSymlink, tar.TypeXGlobalHeader:
+		return nil
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if o.RestoreSpecial {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %q type %q", ErrUnsupportedType, header.Name, header.Typeflag)
+}
+
+// validName rejects entry names that are empty, absolute, or climb out of
+// the destination with .. elements
+func validName(name string) error {
+
+	clean := path.Clean(filepath.ToSlash(name))
+	if name == "" || path.IsAbs(clean) || filepath.IsAbs(name) ||
+		clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("%w: %q", ErrUnsafePath, name)
+	}
+
+	return nil
+}
+
+// validLink rejects symlink targets that are absolute or resolve outside of
+// the destination, which would let later entries be written through them
+func validLink(header *tar.Header) error {
+
+	link := filepath.ToSlash(header.Linkname)
+	if path.IsAbs(link) || filepath.IsAbs(header.Linkname) {
+		return fmt.Errorf("%w: %q links to %q", ErrUnsafePath, header.Name, header.Linkname)
+	}
+	if err := validName(path.Join(path.Dir(filepath.ToSlash(header.Name)), link)); err != nil {
+		return fmt.Errorf("%w: %q links to %q", ErrUnsafePath, header.Name, header.Linkname)
+	}
+
+	return nil
+}
+
+// resolveWithin returns ErrUnsafePath when dir, or the deepest of its
+// parents that exists, resolves through the symlinks on disk to a path
+// outside of dst, such as through a chain of links each valid on its own
+func resolveWithin(dst, dir string) error {
+
+	root, err := filepath.EvalSymlinks(dst)
+	if os.IsNotExist(err) {
+		return nil // nothing extracted yet
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		real, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			rel, err := filepath.Rel(root, real)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return fmt.Errorf("%w: %q resolves outside the destination", ErrUnsafePath, dir)
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+}
+
+// clampName resolves name as if the destination were the filesystem root,
+// so any .. element can climb no higher than the destination
+func clampName(name string) string {
+	if name == "" {
+		return ""
+	}
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+// openFile creates or truncates target for writing; with force a permission
+// failure is retried after making the existing file and its parent directory
+// writable, and the returned restore func puts their original modes back
+func openFile(target string, mode os.FileMode, force bool) (*os.File, func(), error) {
+
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	f, err := os.OpenFile(target, flag, mode)
+	if err == nil || !force || !os.IsPermission(err) {
+		return f, func() {}, err
+	}
+
+	var restores []func()
+	restore := func() {
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
+		}
+	}
+
+	// make the parent directory and then the file itself writable
+	for _, p := range []struct {
+		path string
+		bits os.FileMode
+	}{{filepath.Dir(target), 0300}, {target, 0200}} {
+		info, err := os.Stat(p.path)
+		if err != nil || info.Mode().Perm()&p.bits == p.bits {
+			continue
+		}
+		if err := os.Chmod(p.path, info.Mode().Perm()|p.bits); err != nil {
+			restore()
+			return nil, func() {}, err
+		}
+		path, perm := p.path, info.Mode().Perm()
+		restores = append(restores, func() { os.Chmod(path, perm) })
+	}
+
+	f, err = os.OpenFile(target, flag, mode)
+	if err != nil {
+		restore()
+		return nil, func() {}, err
+	}
+
+	return f, restore, nil
 }
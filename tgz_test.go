@@ -1,11 +1,30 @@
 package tgz_test
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/zxdez/tgz"
 )
@@ -77,3 +96,2824 @@ func TestTarFile(t *testing.T) {
 	t.Logf("target: %s\n hex: %x", filepath.Join(path, target), h.Sum(nil))
 
 }
+
+func TestTarFileName(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "abc123")
+	ioutil.WriteFile(file, []byte("key: value\n"), 0644)
+
+	b := new(bytes.Buffer)
+	if err := tgz.Tar(file, &tar.Header{Name: "config.yaml"}, b); err != nil {
+		t.Fatal(err)
+	}
+	files, err := tgz.UntarMap(b)
+	if err != nil || string(files["config.yaml"]) != "key: value\n" || len(files) != 1 {
+		t.Fatalf("unexpected map %q, %v", files, err)
+	}
+
+	// the base name without opt.Name
+	b.Reset()
+	if err := tgz.Tar(file, nil, b); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := tgz.UntarMap(b); err != nil || len(files["abc123"]) == 0 {
+		t.Fatalf("unexpected map %q, %v", files, err)
+	}
+}
+
+func TestTarSplit(t *testing.T) {
+
+	src := t.TempDir()
+	data := make([]byte, 64<<10)
+	rand.Read(data)
+	if err := ioutil.WriteFile(filepath.Join(src, "data.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	vol := t.TempDir()
+	pattern := filepath.Join(vol, "archive.tgz.%03d")
+	if err := tgz.TarSplit(src, nil, 16<<10, pattern); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(vol, "archive.tgz.002")); err != nil {
+		t.Fatal("expected multiple volumes:", err)
+	}
+
+	dst := t.TempDir()
+	if err := tgz.UntarSplit(dst, pattern); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(dst, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("content mismatch after split round trip")
+	}
+}
+
+func TestTarChanged(t *testing.T) {
+
+	// procfs reports a zero size for files that have content, which
+	// behaves exactly like a file that grew after it was stat'd
+	src := "/proc/self/status"
+	if _, err := os.Stat(src); err != nil {
+		t.Skip("procfs not available")
+	}
+
+	err := tgz.Tar(src, nil, ioutil.Discard)
+	if !errors.Is(err, tgz.ErrChanged) {
+		t.Fatalf("expected ErrChanged, got %v", err)
+	}
+}
+
+func TestTarDedup(t *testing.T) {
+
+	src := t.TempDir()
+	data := make([]byte, 32<<10)
+	rand.Read(data)
+	for _, name := range []string{"a.bin", "b.bin", "c.bin"} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var plain, dedup bytes.Buffer
+	if err := tgz.Tar(src, nil, &plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{Dedup: true}, &dedup); err != nil {
+		t.Fatal(err)
+	}
+	if dedup.Len() >= plain.Len()/2 {
+		t.Fatalf("dedup archive not smaller: %d vs %d", dedup.Len(), plain.Len())
+	}
+
+	dst := t.TempDir()
+	if err := tgz.Untar(dst, &dedup); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dst, "c.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("content mismatch for linked entry")
+	}
+}
+
+func TestTarContentAddressed(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("same\n"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "b.txt"), []byte("same\n"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "c.txt"), []byte("other\n"), 0644)
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{ContentAddressed: true}, b); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if err := tgz.Untar(dst, b); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dst, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest map[string]string
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 3 || manifest["a.txt"] != manifest["b.txt"] {
+		t.Fatalf("unexpected manifest %v", manifest)
+	}
+
+	blobs, _ := ioutil.ReadDir(filepath.Join(dst, "blobs"))
+	if len(blobs) != 2 {
+		t.Fatalf("expected 2 blobs, got %d", len(blobs))
+	}
+}
+
+func TestTarReader(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("test file\n"), 0644)
+
+	// io.Copy uses WriteTo directly
+	var direct bytes.Buffer
+	n, err := io.Copy(&direct, tgz.TarReader(src, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(direct.Len()) {
+		t.Fatalf("count %d does not match %d written", n, direct.Len())
+	}
+
+	// plain reads go through the pipe
+	piped, err := ioutil.ReadAll(io.LimitReader(tgz.TarReader(src, nil, nil), 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(piped, direct.Bytes()) {
+		t.Fatal("piped and direct archives differ")
+	}
+}
+
+func TestUntarForce(t *testing.T) {
+
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("new content\n"), 0644)
+
+	b := new(bytes.Buffer)
+	if err := tgz.Tar(src, nil, b); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+
+	dst := t.TempDir()
+	target := filepath.Join(dst, "a.txt")
+	ioutil.WriteFile(target, []byte("old\n"), 0444)
+
+	if err := tgz.Untar(dst, bytes.NewReader(archive)); !os.IsPermission(errors.Unwrap(err)) && !os.IsPermission(err) {
+		t.Fatalf("expected permission error, got %v", err)
+	}
+
+	if err := tgz.UntarWith(dst, bytes.NewReader(archive), &tgz.UntarOptions{Force: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := ioutil.ReadFile(target)
+	if string(got) != "new content\n" {
+		t.Fatalf("unexpected content %q", got)
+	}
+	if info, _ := os.Stat(target); info.Mode().Perm() != 0444 {
+		t.Fatalf("mode not restored: %v", info.Mode())
+	}
+}
+
+func TestFromZip(t *testing.T) {
+
+	dir := t.TempDir()
+	zipPath := filepath.Join(dir, "test.zip")
+	zf, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(zf)
+	fh := &zip.FileHeader{Name: "sub/a.txt", Method: zip.Deflate}
+	fh.SetMode(0600)
+	w, _ := zw.CreateHeader(fh)
+	w.Write([]byte("zipped\n"))
+	zw.Close()
+	zf.Close()
+
+	b := new(bytes.Buffer)
+	if err := tgz.FromZip(b, zipPath, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if err := tgz.Untar(dst, b); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(dst, "sub", "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "zipped\n" {
+		t.Fatalf("unexpected content %q", got)
+	}
+}
+
+func TestUntarMap(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	b.WriteString("test file\nline1\nline2\n")
+
+	archive := new(bytes.Buffer)
+	if _, err := tgz.Bytes(b, &tar.Header{Name: "a.txt", Mode: 0644}, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := tgz.UntarMap(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(files["a.txt"]) != "test file\nline1\nline2\n" {
+		t.Fatalf("unexpected map %q", files)
+	}
+
+	// names escaping the destination are rejected
+	archive.Reset()
+	b.WriteString("escape")
+	tgz.Bytes(b, &tar.Header{Name: "../escape.txt", Mode: 0644}, archive)
+	if _, err := tgz.UntarMap(archive); !errors.Is(err, tgz.ErrUnsafePath) {
+		t.Fatalf("expected ErrUnsafePath, got %v", err)
+	}
+}
+
+func TestToZip(t *testing.T) {
+
+	archive := new(bytes.Buffer)
+	gzw := gzip.NewWriter(archive)
+	tw := tar.NewWriter(gzw)
+	tw.WriteHeader(&tar.Header{Name: "empty/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0600, Size: 4})
+	tw.Write([]byte("data"))
+	tw.Close()
+	gzw.Close()
+
+	b := new(bytes.Buffer)
+	if err := tgz.ToZip(b, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 2 || zr.File[0].Name != "empty/" || !zr.File[0].FileInfo().IsDir() {
+		t.Fatalf("directory entry not preserved")
+	}
+	if zr.File[1].Name != "a.txt" || zr.File[1].Mode().Perm() != 0600 {
+		t.Fatalf("unexpected file entry %s %v", zr.File[1].Name, zr.File[1].Mode())
+	}
+}
+
+func TestUntarMaxFileBytes(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	b.WriteString("0123456789")
+
+	archive := new(bytes.Buffer)
+	if _, err := tgz.Bytes(b, &tar.Header{Name: "a.txt", Mode: 0644}, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	err := tgz.UntarWith(t.TempDir(), archive, &tgz.UntarOptions{MaxFileBytes: 5})
+	if !errors.Is(err, tgz.ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+}
+
+func TestArchiver(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("test file\n"), 0644)
+
+	var want bytes.Buffer
+	if err := tgz.Tar(src, nil, &want); err != nil {
+		t.Fatal(err)
+	}
+
+	a := new(tgz.Archiver)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var got bytes.Buffer
+			if err := a.Tar(src, nil, &got); err != nil {
+				t.Error(err)
+			}
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Error("pooled archive differs from Tar")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkArchiver(b *testing.B) {
+
+	src := b.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("test file\n"), 0644)
+
+	a := new(tgz.Archiver)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		a.Tar(src, nil, ioutil.Discard)
+	}
+}
+
+func TestUntarTextConvert(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("one\r\ntwo\nthree\r\n"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "a.bin"), []byte("one\r\ntwo\n"), 0644)
+
+	b := new(bytes.Buffer)
+	if err := tgz.Tar(src, nil, b); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+
+	for _, tc := range []struct {
+		crlf bool
+		want string
+	}{
+		{false, "one\ntwo\nthree\n"},
+		{true, "one\r\ntwo\r\nthree\r\n"},
+	} {
+		dst := t.TempDir()
+		err := tgz.UntarWith(dst, bytes.NewReader(archive), &tgz.UntarOptions{
+			TextConvert: &tgz.TextConvert{Extensions: []string{".txt"}, CRLF: tc.crlf},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := ioutil.ReadFile(filepath.Join(dst, "a.txt")); string(got) != tc.want {
+			t.Errorf("crlf=%v: got %q want %q", tc.crlf, got, tc.want)
+		}
+		if got, _ := ioutil.ReadFile(filepath.Join(dst, "a.bin")); string(got) != "one\r\ntwo\n" {
+			t.Errorf("binary entry was converted: %q", got)
+		}
+	}
+}
+
+func TestGzip(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	b.WriteString("test file\nline1\nline2\n")
+
+	h := sha256.New()
+	gz := new(bytes.Buffer)
+	if _, err := tgz.Gzip(b, gz, h); err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(bytes.Buffer)
+	n, err := tgz.Gunzip(out, gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 22 || out.String() != "test file\nline1\nline2\n" {
+		t.Fatalf("unexpected content %q", out)
+	}
+
+	t.Logf("hex: %x", h.Sum(nil))
+}
+
+func TestWalkInto(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("test file\n"), 0644)
+
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	if err := tgz.WalkInto(tw, src, nil); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+
+	// the output is a plain tar without gzip
+	header, err := tar.NewReader(b).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Name != "a.txt" {
+		t.Fatalf("unexpected entry %q", header.Name)
+	}
+}
+
+func TestUntarBirthTime(t *testing.T) {
+
+	archive := new(bytes.Buffer)
+	gzw := gzip.NewWriter(archive)
+	tw := tar.NewWriter(gzw)
+	tw.WriteHeader(&tar.Header{
+		Name:       "a.txt",
+		Mode:       0644,
+		Size:       4,
+		PAXRecords: map[string]string{"LIBARCHIVE.creationtime": "1600000000.5"},
+	})
+	tw.Write([]byte("data"))
+	tw.Close()
+	gzw.Close()
+
+	// unsupported platforms degrade silently
+	if err := tgz.UntarWith(t.TempDir(), archive, &tgz.UntarOptions{BirthTime: true}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUntarErrorName(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	b.WriteString("data")
+
+	archive := new(bytes.Buffer)
+	tgz.Bytes(b, &tar.Header{Name: "a.txt", Mode: 0644}, archive)
+
+	// a directory in the way of the file makes the open fail
+	dst := t.TempDir()
+	os.Mkdir(filepath.Join(dst, "a.txt"), 0755)
+
+	err := tgz.Untar(dst, archive)
+	if err == nil || !strings.Contains(err.Error(), `"a.txt"`) {
+		t.Fatalf("expected error naming the entry, got %v", err)
+	}
+}
+
+func TestTarSorted(t *testing.T) {
+
+	src := t.TempDir()
+	for _, name := range []string{"b.txt", "B.txt", "a/z.txt", "a.txt", "_.txt"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0755)
+		ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644)
+	}
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{Sorted: true}, b); err != nil {
+		t.Fatal(err)
+	}
+
+	gzr, _ := gzip.NewReader(b)
+	tr := tar.NewReader(gzr)
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+	}
+
+	want := []string{"B.txt", "_.txt", "a/z.txt", "a.txt", "b.txt"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("got order %v want %v", names, want)
+	}
+}
+
+func TestTarWorkers(t *testing.T) {
+
+	src := t.TempDir()
+	for i := 0; i < 50; i++ {
+		data := make([]byte, i*512)
+		rand.Read(data)
+		ioutil.WriteFile(filepath.Join(src, fmt.Sprintf("file%02d.bin", i)), data, 0644)
+	}
+
+	var serial, parallel bytes.Buffer
+	if err := tgz.Tar(src, nil, &serial); err != nil {
+		t.Fatal(err)
+	}
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{Workers: 4}, &parallel); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(serial.Bytes(), parallel.Bytes()) {
+		t.Fatal("parallel archive differs from serial archive")
+	}
+}
+
+func BenchmarkTarWorkers(b *testing.B) {
+
+	src := b.TempDir()
+	data := make([]byte, 16<<10)
+	for i := 0; i < 200; i++ {
+		ioutil.WriteFile(filepath.Join(src, fmt.Sprintf("file%03d.bin", i)), data, 0644)
+	}
+
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tgz.TarWith(src, nil, &tgz.TarOptions{Workers: workers}, ioutil.Discard)
+			}
+		})
+	}
+}
+
+func TestTarDigests(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("test file\n"), 0644)
+
+	b := new(bytes.Buffer)
+	md5sum, sha256sum, err := tgz.TarDigests(src, nil, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := md5.Sum(b.Bytes()); !bytes.Equal(md5sum, want[:]) {
+		t.Fatal("md5 digest mismatch")
+	}
+	if want := sha256.Sum256(b.Bytes()); !bytes.Equal(sha256sum, want[:]) {
+		t.Fatal("sha256 digest mismatch")
+	}
+}
+
+func TestTarBodyTransform(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("secret"), 0644)
+
+	// a transform that changes the size of the body
+	double := func(name string, r io.Reader) (io.Reader, error) {
+		b, err := ioutil.ReadAll(r)
+		return bytes.NewReader(append(b, b...)), err
+	}
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{BodyTransform: double}, b); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := tgz.UntarMap(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(files["a.txt"]) != "secretsecret" {
+		t.Fatalf("unexpected body %q", files["a.txt"])
+	}
+
+	// a single file is transformed the same
+	b.Reset()
+	if err := tgz.TarWith(filepath.Join(src, "a.txt"), nil, &tgz.TarOptions{BodyTransform: double}, b); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := tgz.UntarMap(b); err != nil || string(files["a.txt"]) != "secretsecret" {
+		t.Fatalf("unexpected map %q, %v", files, err)
+	}
+}
+
+func TestAddFile(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "a.txt")
+	ioutil.WriteFile(file, []byte("open file\n"), 0644)
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	b := new(bytes.Buffer)
+	w := tgz.NewWriter(b, nil)
+	if err := tgz.AddFile(w, f, "renamed.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := tgz.UntarMap(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(files["renamed.txt"]) != "open file\n" {
+		t.Fatalf("unexpected map %q", files)
+	}
+}
+
+func TestUntarStrict(t *testing.T) {
+
+	archive := new(bytes.Buffer)
+	gzw := gzip.NewWriter(archive)
+	tw := tar.NewWriter(gzw)
+	tw.WriteHeader(&tar.Header{Name: "null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3})
+	tw.Close()
+	gzw.Close()
+	data := archive.Bytes()
+
+	// skipped by default
+	if err := tgz.Untar(t.TempDir(), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := tgz.UntarWith(t.TempDir(), bytes.NewReader(data), &tgz.UntarOptions{Strict: true})
+	if !errors.Is(err, tgz.ErrUnsupportedType) {
+		t.Fatalf("expected ErrUnsupportedType, got %v", err)
+	}
+}
+
+func TestUntarDirAfterFiles(t *testing.T) {
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	archive := new(bytes.Buffer)
+	gzw := gzip.NewWriter(archive)
+	tw := tar.NewWriter(gzw)
+	tw.WriteHeader(&tar.Header{Name: "sub/a.txt", Mode: 0644, Size: 4})
+	tw.Write([]byte("data"))
+	tw.WriteHeader(&tar.Header{Name: "sub/", Typeflag: tar.TypeDir, Mode: 0700, ModTime: mtime})
+	tw.Close()
+	gzw.Close()
+
+	dst := t.TempDir()
+	if err := tgz.Untar(dst, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dst, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 || !info.ModTime().Equal(mtime) {
+		t.Fatalf("directory attributes not applied: %v %v", info.Mode(), info.ModTime())
+	}
+
+	// a wide mode still goes through the umask, as for a new directory
+	probe := filepath.Join(t.TempDir(), "probe")
+	os.Mkdir(probe, 0777)
+	masked, _ := os.Stat(probe)
+
+	archive.Reset()
+	gzw = gzip.NewWriter(archive)
+	tw = tar.NewWriter(gzw)
+	tw.WriteHeader(&tar.Header{Name: "pub/a.txt", Mode: 0644, Size: 4})
+	tw.Write([]byte("data"))
+	tw.WriteHeader(&tar.Header{Name: "pub/", Typeflag: tar.TypeDir, Mode: 0777})
+	tw.Close()
+	gzw.Close()
+
+	if err := tgz.Untar(dst, archive); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(filepath.Join(dst, "pub")); info.Mode().Perm() != masked.Mode().Perm() {
+		t.Fatalf("directory mode %v, want %v", info.Mode().Perm(), masked.Mode().Perm())
+	}
+}
+
+func TestTarSmallFileBytes(t *testing.T) {
+
+	src := t.TempDir()
+	for i := 0; i < 20; i++ {
+		ioutil.WriteFile(filepath.Join(src, fmt.Sprintf("conf%02d.ini", i)), bytes.Repeat([]byte("k=v\n"), i), 0644)
+	}
+
+	var plain, small bytes.Buffer
+	if err := tgz.Tar(src, nil, &plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{SmallFileBytes: 40}, &small); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain.Bytes(), small.Bytes()) {
+		t.Fatal("buffered archive differs from plain archive")
+	}
+}
+
+func TestUntarClampPaths(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	b.WriteString("escape")
+
+	archive := new(bytes.Buffer)
+	tgz.Bytes(b, &tar.Header{Name: "../../etc/escape.txt", Mode: 0644}, archive)
+	data := archive.Bytes()
+
+	dst := t.TempDir()
+	if err := tgz.Untar(dst, bytes.NewReader(data)); !errors.Is(err, tgz.ErrUnsafePath) {
+		t.Fatalf("expected ErrUnsafePath, got %v", err)
+	}
+
+	if err := tgz.UntarWith(dst, bytes.NewReader(data), &tgz.UntarOptions{ClampPaths: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "etc", "escape.txt")); err != nil {
+		t.Fatal("clamped entry not inside destination:", err)
+	}
+}
+
+func TestUntarSymlinkChain(t *testing.T) {
+
+	parent := t.TempDir()
+	dst := filepath.Join(parent, "dst")
+	os.Mkdir(dst, 0755)
+
+	// each link stays inside on its own, but d/x/y resolves to parent
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	tw.WriteHeader(&tar.Header{Name: "d/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "d/x", Typeflag: tar.TypeSymlink, Linkname: ".."})
+	tw.WriteHeader(&tar.Header{Name: "d/x/y", Typeflag: tar.TypeSymlink, Linkname: ".."})
+	tw.WriteHeader(&tar.Header{Name: "d/x/y/evil.txt", Mode: 0644, Size: 4})
+	tw.Write([]byte("evil"))
+	tw.Close()
+
+	for _, o := range []*tgz.UntarOptions{nil, {ClampPaths: true}} {
+		if err := tgz.UntarWith(dst, bytes.NewReader(b.Bytes()), o); !errors.Is(err, tgz.ErrUnsafePath) {
+			t.Fatalf("expected ErrUnsafePath, got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(parent, "evil.txt")); !os.IsNotExist(err) {
+			t.Fatal("entry written outside the destination")
+		}
+	}
+
+	// a file entry replaces a planted link to a file outside
+	ioutil.WriteFile(filepath.Join(parent, "outside.txt"), []byte("keep"), 0644)
+	b.Reset()
+	tw = tar.NewWriter(b)
+	tw.WriteHeader(&tar.Header{Name: "d/x/z", Typeflag: tar.TypeSymlink, Linkname: "../outside.txt"})
+	tw.WriteHeader(&tar.Header{Name: "z", Mode: 0644, Size: 4})
+	tw.Write([]byte("evil"))
+	tw.Close()
+
+	if err := tgz.Untar(dst, b); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(parent, "outside.txt")); string(data) != "keep" {
+		t.Fatalf("file outside the destination overwritten: %q", data)
+	}
+}
+
+func TestTarLatestModTime(t *testing.T) {
+
+	src := t.TempDir()
+	newest := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, name := range []string{"a.txt", "b.txt"} {
+		file := filepath.Join(src, name)
+		ioutil.WriteFile(file, []byte(name), 0644)
+		mtime := newest.Add(-time.Duration(i) * time.Hour)
+		os.Chtimes(file, mtime, mtime)
+	}
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{LatestModTime: true}, b); err != nil {
+		t.Fatal(err)
+	}
+
+	gzr, err := gzip.NewReader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gzr.Header.ModTime.Equal(newest) {
+		t.Fatalf("gzip ModTime %v, want %v", gzr.Header.ModTime, newest)
+	}
+}
+
+func TestRecompress(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	b.WriteString(strings.Repeat("test file\nline1\nline2\n", 1000))
+
+	archive := new(bytes.Buffer)
+	if _, err := tgz.Bytes(b, &tar.Header{Name: "a.txt", Mode: 0644}, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	best := new(bytes.Buffer)
+	if err := tgz.Recompress(best, bytes.NewReader(archive.Bytes()), gzip.BestCompression); err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := tgz.UntarMap(archive)
+	got, err := tgz.UntarMap(best)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got["a.txt"], want["a.txt"]) {
+		t.Fatal("recompressed content differs")
+	}
+}
+
+func TestTarRequireEntries(t *testing.T) {
+
+	src := t.TempDir()
+
+	if err := tgz.Tar(src, nil, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	err := tgz.TarWith(src, nil, &tgz.TarOptions{RequireEntries: true}, ioutil.Discard)
+	if !errors.Is(err, tgz.ErrEmpty) {
+		t.Fatalf("expected ErrEmpty, got %v", err)
+	}
+}
+
+func TestTarSortEntries(t *testing.T) {
+
+	src := t.TempDir()
+	for _, name := range []string{"b.txt", "a/z.txt", "a.txt", "a-b.txt"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0755)
+		ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644)
+	}
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{SortEntries: true}, b); err != nil {
+		t.Fatal(err)
+	}
+
+	gzr, _ := gzip.NewReader(b)
+	tr := tar.NewReader(gzr)
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+	}
+
+	// full path order puts a.txt ahead of the a/ directory contents
+	want := []string{"a-b.txt", "a.txt", "a/z.txt", "b.txt"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("got order %v want %v", names, want)
+	}
+}
+
+func TestUntarSpecialBits(t *testing.T) {
+
+	archive := new(bytes.Buffer)
+	gzw := gzip.NewWriter(archive)
+	tw := tar.NewWriter(gzw)
+	tw.WriteHeader(&tar.Header{Name: "shared/", Typeflag: tar.TypeDir, Mode: 01777})
+	tw.WriteHeader(&tar.Header{Name: "shared/bin", Mode: 04755, Size: 4})
+	tw.Write([]byte("data"))
+	tw.Close()
+	gzw.Close()
+	data := archive.Bytes()
+
+	dst := t.TempDir()
+	if err := tgz.Untar(dst, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(filepath.Join(dst, "shared", "bin")); info.Mode()&os.ModeSetuid != 0 {
+		t.Fatal("setuid restored without SpecialBits")
+	}
+
+	dst = t.TempDir()
+	if err := tgz.UntarWith(dst, bytes.NewReader(data), &tgz.UntarOptions{SpecialBits: true}); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(filepath.Join(dst, "shared")); info.Mode()&os.ModeSticky == 0 {
+		t.Fatalf("sticky bit not restored: %v", info.Mode())
+	}
+	if info, _ := os.Stat(filepath.Join(dst, "shared", "bin")); info.Mode()&os.ModeSetuid == 0 {
+		t.Fatalf("setuid bit not restored: %v", info.Mode())
+	}
+}
+
+func TestTarWithChecksums(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("alpha\n"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "b.txt"), []byte("bravo\n"), 0644)
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{WithChecksums: true}, b); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := tgz.UntarMap(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want string
+	for _, name := range []string{"a.txt", "b.txt"} {
+		want += fmt.Sprintf("%x  %s\n", sha256.Sum256(files[name]), name)
+	}
+	if string(files["SHA256SUMS"]) != want {
+		t.Fatalf("got SHA256SUMS %q want %q", files["SHA256SUMS"], want)
+	}
+
+	// a single file gets the checksums entry too
+	b.Reset()
+	if err := tgz.TarWith(filepath.Join(src, "a.txt"), nil, &tgz.TarOptions{WithChecksums: true}, b); err != nil {
+		t.Fatal(err)
+	}
+	files, err = tgz.UntarMap(b)
+	if want := fmt.Sprintf("%x  a.txt\n", sha256.Sum256([]byte("alpha\n"))); err != nil || string(files["SHA256SUMS"]) != want {
+		t.Fatalf("got SHA256SUMS %q want %q, %v", files["SHA256SUMS"], want, err)
+	}
+}
+
+func TestTarEmbedChecksums(t *testing.T) {
+
+	src := t.TempDir()
+	os.Mkdir(filepath.Join(src, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("alpha\n"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "sub", "b.txt"), []byte("bravo\n"), 0644)
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{EmbedChecksums: true}, b); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+
+	headers, err := tgz.List(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 3 || headers[0].Name != "SHA256SUMS" {
+		t.Fatalf("checksums not first: %+v", headers)
+	}
+
+	files, err := tgz.UntarMap(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want string
+	for _, name := range []string{"a.txt", filepath.Join("sub", "b.txt")} {
+		want += fmt.Sprintf("%x  %s\n", sha256.Sum256(files[name]), name)
+	}
+	if string(files["SHA256SUMS"]) != want {
+		t.Fatalf("got SHA256SUMS %q want %q", files["SHA256SUMS"], want)
+	}
+
+	// a single file
+	b.Reset()
+	if err := tgz.TarWith(filepath.Join(src, "a.txt"), nil, &tgz.TarOptions{EmbedChecksums: true}, b); err != nil {
+		t.Fatal(err)
+	}
+	files, err = tgz.UntarMap(b)
+	if want := fmt.Sprintf("%x  a.txt\n", sha256.Sum256([]byte("alpha\n"))); err != nil || string(files["SHA256SUMS"]) != want {
+		t.Fatalf("got SHA256SUMS %q want %q, %v", files["SHA256SUMS"], want, err)
+	}
+
+	// a single SHA256SUMS alongside WithChecksums
+	b.Reset()
+	o := &tgz.TarOptions{EmbedChecksums: true, WithChecksums: true}
+	if err := tgz.TarWith(src, nil, o, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := tgz.UntarWith(t.TempDir(), b, &tgz.UntarOptions{RejectDuplicates: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a transform need not give the same body twice
+	o = &tgz.TarOptions{EmbedChecksums: true, BodyTransform: func(name string, r io.Reader) (io.Reader, error) {
+		return r, nil
+	}}
+	if err := tgz.TarWith(src, nil, o, ioutil.Discard); err == nil {
+		t.Fatal("expected EmbedChecksums with BodyTransform to fail")
+	}
+}
+
+func TestMerge(t *testing.T) {
+
+	archive := func(name, data string) *bytes.Buffer {
+		b, out := new(bytes.Buffer), new(bytes.Buffer)
+		b.WriteString(data)
+		tgz.Bytes(b, &tar.Header{Name: name, Mode: 0640}, out)
+		return out
+	}
+
+	b := new(bytes.Buffer)
+	if err := tgz.Merge(b, archive("a.txt", "alpha"), archive("b.txt", "bravo")); err != nil {
+		t.Fatal(err)
+	}
+	files, err := tgz.UntarMap(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(files["a.txt"]) != "alpha" || string(files["b.txt"]) != "bravo" {
+		t.Fatalf("unexpected merge %q", files)
+	}
+
+	err = tgz.Merge(ioutil.Discard, archive("a.txt", "alpha"), archive("a.txt", "again"))
+	if !errors.Is(err, tgz.ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate, got %v", err)
+	}
+}
+
+func TestUntarPAXSymlink(t *testing.T) {
+
+	// names and targets beyond 100 bytes need PAX extended headers
+	long := strings.Repeat("directory/", 12) + "file.txt"
+
+	archive := new(bytes.Buffer)
+	gzw := gzip.NewWriter(archive)
+	tw := tar.NewWriter(gzw)
+	tw.WriteHeader(&tar.Header{Name: long, Mode: 0644, Size: 4, Format: tar.FormatPAX})
+	tw.Write([]byte("data"))
+	tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: long, Format: tar.FormatPAX})
+	tw.WriteHeader(&tar.Header{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: "../outside", Format: tar.FormatPAX})
+	tw.Close()
+	gzw.Close()
+	data := archive.Bytes()
+
+	dst := t.TempDir()
+	if err := tgz.Untar(dst, bytes.NewReader(data)); !errors.Is(err, tgz.ErrUnsafePath) {
+		t.Fatalf("expected ErrUnsafePath for escaping link, got %v", err)
+	}
+
+	link, err := os.Readlink(filepath.Join(dst, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != long {
+		t.Fatalf("long symlink target not restored: %q", link)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dst, "link")); string(got) != "data" {
+		t.Fatalf("symlink does not resolve: %q", got)
+	}
+}
+
+func TestCountingWriter(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	b.WriteString(strings.Repeat("test file\nline1\nline2\n", 100))
+
+	out := new(bytes.Buffer)
+	cw := new(tgz.CountingWriter)
+	n, err := tgz.Bytes(b, nil, out, cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2200 {
+		t.Fatalf("uncompressed count %d", n)
+	}
+	if cw.N != int64(out.Len()) || cw.N >= n {
+		t.Fatalf("compressed count %d, archive %d bytes", cw.N, out.Len())
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+
+	if h := tgz.ApplyDefaults(nil); !reflect.DeepEqual(h, tgz.DefaultHeader()) {
+		t.Fatalf("nil did not return the defaults: %+v", h)
+	}
+
+	opt := &tar.Header{Name: "a.txt", Uname: "server"}
+	h := tgz.ApplyDefaults(opt)
+	if h.Name != "a.txt" || h.Uname != "server" || h.Gname != "user" || h.Mode != 0644 {
+		t.Fatalf("unexpected defaults %+v", h)
+	}
+	if opt.Gname != "" || opt.Mode != 0 {
+		t.Fatal("the caller header was modified")
+	}
+}
+
+func TestTarStore(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.jpg"), []byte("already compressed"), 0644)
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{Store: true}, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// plain tar readable without gzip
+	if _, err := tar.NewReader(bytes.NewReader(b.Bytes())).Next(); err != nil {
+		t.Fatal("not a plain tar:", err)
+	}
+
+	dst := t.TempDir()
+	if err := tgz.Untar(dst, b); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dst, "a.jpg")); string(got) != "already compressed" {
+		t.Fatalf("unexpected content %q", got)
+	}
+}
+
+func TestUntarMaxFileBytesStream(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	b.WriteString("a\nb\nc\nd\n")
+
+	archive := new(bytes.Buffer)
+	tgz.Bytes(b, &tar.Header{Name: "a.txt", Mode: 0644}, archive)
+
+	// the declared size passes but the converted body outgrows the cap
+	err := tgz.UntarWith(t.TempDir(), archive, &tgz.UntarOptions{
+		MaxFileBytes: 10,
+		TextConvert:  &tgz.TextConvert{Extensions: []string{".txt"}, CRLF: true},
+	})
+	if !errors.Is(err, tgz.ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+}
+
+// countingReadSeeker counts the bytes read through it
+type countingReadSeeker struct {
+	io.ReadSeeker
+	n int
+}
+
+func (c *countingReadSeeker) Read(p []byte) (int, error) {
+	n, err := c.ReadSeeker.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestListSeek(t *testing.T) {
+
+	src := t.TempDir()
+	for _, name := range []string{"a.bin", "b.bin"} {
+		ioutil.WriteFile(filepath.Join(src, name), make([]byte, 1<<20), 0644)
+	}
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{Store: true}, b); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &countingReadSeeker{ReadSeeker: bytes.NewReader(b.Bytes())}
+	headers, err := tgz.List(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 2 || headers[0].Name != "a.bin" || headers[1].Name != "b.bin" {
+		t.Fatalf("unexpected listing %v", headers)
+	}
+	if r.n > 64<<10 {
+		t.Fatalf("bodies were read rather than skipped: %d bytes read", r.n)
+	}
+}
+
+func TestListTop(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	for _, name := range []string{"./b.txt", "src/", "src/main.go", "docs/api/index.md", "src/lib/util.go", "a.txt"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644})
+	}
+	tw.Close()
+
+	names, err := tgz.ListTop(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b.txt", "src", "docs", "a.txt"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("top level %q, want %q", names, want)
+	}
+}
+
+func TestTarDirs(t *testing.T) {
+
+	src := t.TempDir()
+	os.Mkdir(filepath.Join(src, "private"), 0700)
+	os.Mkdir(filepath.Join(src, "empty"), 0755)
+	os.Chmod(filepath.Join(src, "private"), 0700)
+	ioutil.WriteFile(filepath.Join(src, "private", "key"), []byte("secret"), 0600)
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{Dirs: true}, b); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if err := tgz.Untar(dst, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(filepath.Join(dst, "empty")); err != nil || !info.IsDir() {
+		t.Fatal("empty directory not restored:", err)
+	}
+	if info, _ := os.Stat(filepath.Join(dst, "private")); info.Mode().Perm() != 0700 {
+		t.Fatalf("private directory mode not kept: %v", info.Mode())
+	}
+}
+
+func TestTarDirsFirst(t *testing.T) {
+
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "a", "b"), 0750)
+	ioutil.WriteFile(filepath.Join(src, "a", "b", "c.txt"), []byte("c"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "top.txt"), []byte("top"), 0644)
+
+	// the deepest file first, ahead of its directories in walk order
+	deepest := func(paths []string) []string {
+		sort.Slice(paths, func(i, j int) bool { return len(paths[i]) > len(paths[j]) })
+		return paths
+	}
+
+	for _, dirs := range []bool{false, true} {
+		b := new(bytes.Buffer)
+		o := &tgz.TarOptions{DirsFirst: true, Dirs: dirs, Order: deepest}
+		if err := tgz.TarWith(src, nil, o, b); err != nil {
+			t.Fatal(err)
+		}
+
+		headers, err := tgz.List(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, h := range headers {
+			names = append(names, h.Name)
+		}
+		if want := []string{"a/", "a/b/", "a/b/c.txt", "top.txt"}; !reflect.DeepEqual(names, want) {
+			t.Fatalf("dirs %v: entries %q, want %q", dirs, names, want)
+		}
+		if headers[1].Typeflag != tar.TypeDir || headers[1].Mode != 0750 {
+			t.Fatalf("unexpected directory header %+v", headers[1])
+		}
+	}
+
+	names := func(b *bytes.Buffer) []string {
+		headers, err := tgz.List(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, h := range headers {
+			names = append(names, h.Name)
+		}
+		return names
+	}
+
+	// a single file named into a directory of the archive
+	b := new(bytes.Buffer)
+	file := filepath.Join(src, "top.txt")
+	if err := tgz.TarWith(file, &tar.Header{Name: "a/b/f.txt"}, &tgz.TarOptions{DirsFirst: true}, b); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(b), []string{"a/", "a/b/", "a/b/f.txt"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("single file: entries %q, want %q", got, want)
+	}
+
+	// sources and bytes written one at a time
+	b.Reset()
+	sources := []tgz.Source{
+		{Name: "x/y/one.txt", Size: 3, Body: strings.NewReader("one")},
+		{Name: "x/two.txt", Size: 3, Body: strings.NewReader("two")},
+	}
+	if err := tgz.TarSourcesWith(sources, nil, &tgz.TarOptions{DirsFirst: true}, b); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(b), []string{"x/", "x/y/", "x/y/one.txt", "x/two.txt"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("sources: entries %q, want %q", got, want)
+	}
+
+	b.Reset()
+	tw, err := tgz.NewWriterWith(b, nil, &tgz.TarOptions{DirsFirst: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw.AddBytes("p/q.txt", []byte("q"))
+	tw.AddBytes("p/r.txt", []byte("r"))
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(b), []string{"p/", "p/q.txt", "p/r.txt"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("writer: entries %q, want %q", got, want)
+	}
+}
+
+func TestTarEvents(t *testing.T) {
+
+	src := t.TempDir()
+	os.Mkdir(filepath.Join(src, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("alpha"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "sub", "b.txt"), []byte("be"), 0644)
+
+	events := new(bytes.Buffer)
+	o := &tgz.TarOptions{Events: events, Sorted: true}
+	if err := tgz.TarWith(src, &tar.Header{Mode: 0640}, o, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	type event struct {
+		Name string `json:"name"`
+		Size int64  `json:"size"`
+		Mode int64  `json:"mode"`
+	}
+	if n := strings.Count(events.String(), "\n"); n != 2 {
+		t.Fatalf("%d event lines", n)
+	}
+	var got []event
+	dec := json.NewDecoder(events)
+	for dec.More() {
+		var e event
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, e)
+	}
+	want := []event{{"a.txt", 5, 0640}, {filepath.Join("sub", "b.txt"), 2, 0640}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("events %+v, want %+v", got, want)
+	}
+}
+
+func TestTarSkipEmpty(t *testing.T) {
+
+	src := t.TempDir()
+	os.Mkdir(filepath.Join(src, "logs"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "logs", ".gitkeep"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644)
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{SkipEmpty: true, Dirs: true}, b); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, err := tgz.List(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, h := range headers {
+		names = append(names, h.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"a.txt", "logs/"}) {
+		t.Fatalf("unexpected entries %q", names)
+	}
+
+	// a single empty file leaves nothing to archive
+	o := &tgz.TarOptions{SkipEmpty: true, RequireEntries: true}
+	if err := tgz.TarWith(filepath.Join(src, "logs", ".gitkeep"), nil, o, ioutil.Discard); !errors.Is(err, tgz.ErrEmpty) {
+		t.Fatalf("expected ErrEmpty, got %v", err)
+	}
+}
+
+func TestFile(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	if _, err := tgz.File("config.yaml", []byte("key: value\n"), 0600, b); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, err := tgz.List(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 1 || headers[0].Name != "config.yaml" || headers[0].Mode != 0600 {
+		t.Fatalf("unexpected header %+v", headers[0])
+	}
+}
+
+func TestGzipHeader(t *testing.T) {
+
+	mtime := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	b := new(bytes.Buffer)
+	gzw := gzip.NewWriter(b)
+	gzw.Name, gzw.Comment, gzw.ModTime = "archive.tar", "release", mtime
+	gzw.Write([]byte("content"))
+	gzw.Close()
+
+	h, err := tgz.GzipHeader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Name != "archive.tar" || h.Comment != "release" || !h.ModTime.Equal(mtime) {
+		t.Fatalf("unexpected header %+v", h)
+	}
+}
+
+func TestAppendBytes(t *testing.T) {
+
+	dst := make([]byte, 0, 4096)
+	out, err := tgz.AppendBytes(dst, bytes.NewBufferString("payload"), &tar.Header{Name: "a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &out[0] != &dst[:1][0] {
+		t.Fatal("archive not written into dst")
+	}
+
+	headers, err := tgz.List(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 1 || headers[0].Name != "a.txt" || headers[0].Size != 7 {
+		t.Fatalf("unexpected headers %+v", headers)
+	}
+}
+
+func TestRelativeSymlinks(t *testing.T) {
+
+	src := t.TempDir()
+	os.Mkdir(filepath.Join(src, "bin"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "tool"), []byte("tool"), 0644)
+	os.Symlink(filepath.Join(src, "tool"), filepath.Join(src, "bin", "tool"))
+
+	b := new(bytes.Buffer)
+	o := &tgz.TarOptions{Symlinks: true, RelativeSymlinks: true}
+	if err := tgz.TarWith(src, nil, o, b); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if err := tgz.Untar(dst, bytes.NewReader(b.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	link, err := os.Readlink(filepath.Join(dst, "bin", "tool"))
+	if err != nil || link != "../tool" {
+		t.Fatalf("link %q, %v", link, err)
+	}
+
+	// a link leaving the tree is rejected
+	os.Symlink("/etc/passwd", filepath.Join(src, "passwd"))
+	if err := tgz.TarWith(src, nil, o, ioutil.Discard); !errors.Is(err, tgz.ErrUnsafePath) {
+		t.Fatalf("expected ErrUnsafePath, got %v", err)
+	}
+}
+
+func TestUntarRejectDuplicates(t *testing.T) {
+
+	// the same entry spelled the same and differently
+	for _, second := range []string{"a.txt", "./a.txt"} {
+		b := new(bytes.Buffer)
+		tw := tar.NewWriter(b)
+		for _, name := range []string{"a.txt", second} {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 4})
+			tw.Write([]byte("data"))
+		}
+		tw.Close()
+
+		err := tgz.UntarWith(t.TempDir(), bytes.NewReader(b.Bytes()), &tgz.UntarOptions{RejectDuplicates: true})
+		if !errors.Is(err, tgz.ErrDuplicate) || !strings.Contains(err.Error(), "a.txt") {
+			t.Fatalf("%s: expected ErrDuplicate for a.txt, got %v", second, err)
+		}
+	}
+}
+
+func TestUntarForceMode(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0777})
+	tw.WriteHeader(&tar.Header{Name: "dir/a.sh", Mode: 0777, Size: 4})
+	tw.Write([]byte("echo"))
+	tw.Close()
+
+	dst := t.TempDir()
+	if err := tgz.UntarWith(dst, b, &tgz.UntarOptions{ForceMode: 0600}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]os.FileMode{"dir": 0700, "dir/a.sh": 0600} {
+		info, err := os.Stat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Fatalf("%s: mode %v, want %v", name, info.Mode().Perm(), want)
+		}
+	}
+}
+
+func TestUntarMaxDepth(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	tgz.Bytes(bytes.NewBufferString("deep"), &tar.Header{Name: "a/b/c/d.txt", Mode: 0644}, b)
+	archive := b.Bytes()
+
+	if err := tgz.UntarWith(t.TempDir(), bytes.NewReader(archive), &tgz.UntarOptions{MaxDepth: 4}); err != nil {
+		t.Fatal(err)
+	}
+	err := tgz.UntarWith(t.TempDir(), bytes.NewReader(archive), &tgz.UntarOptions{MaxDepth: 3})
+	if !errors.Is(err, tgz.ErrTooDeep) {
+		t.Fatalf("expected ErrTooDeep, got %v", err)
+	}
+}
+
+func TestUntarInspect(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "keep.txt"), []byte("keep"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "skip.log"), []byte("skip"), 0644)
+
+	b := new(bytes.Buffer)
+	if err := tgz.Tar(src, nil, b); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+
+	dst := t.TempDir()
+	err := tgz.UntarInspect(dst, func(header *tar.Header) error {
+		if strings.HasSuffix(header.Name, ".log") {
+			return tgz.ErrSkip
+		}
+		return nil
+	}, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "keep.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "skip.log")); !os.IsNotExist(err) {
+		t.Fatal("skipped entry was extracted")
+	}
+
+	// any other error aborts
+	denied := errors.New("denied")
+	err = tgz.UntarInspect(t.TempDir(), func(*tar.Header) error { return denied }, bytes.NewReader(archive))
+	if err != denied {
+		t.Fatalf("expected denied, got %v", err)
+	}
+}
+
+func TestUntarHashes(t *testing.T) {
+
+	src := t.TempDir()
+	os.Mkdir(filepath.Join(src, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("alpha"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "sub", "b.txt"), []byte("beta"), 0644)
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{Dirs: true}, b); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	sums, err := tgz.UntarHashes(dst, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sums) != 2 {
+		t.Fatalf("unexpected hashes %x", sums)
+	}
+	for name, sum := range sums {
+		data, err := ioutil.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := sha256.Sum256(data); !bytes.Equal(sum, want[:]) {
+			t.Fatalf("%s: hash %x, want %x", name, sum, want)
+		}
+	}
+}
+
+func TestUntarFlatten(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	tw.WriteHeader(&tar.Header{Name: "deep/", Typeflag: tar.TypeDir, Mode: 0755})
+	for name, body := range map[string]string{"deep/er/a.txt": "a", "b.txt": "b", "deep/c.txt": "c"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body))})
+		tw.Write([]byte(body))
+	}
+	tw.WriteHeader(&tar.Header{Name: "deep/er/link", Typeflag: tar.TypeLink, Linkname: "deep/er/a.txt"})
+	tw.WriteHeader(&tar.Header{Name: "deep/er/sym", Typeflag: tar.TypeSymlink, Linkname: "../c.txt"})
+	tw.WriteHeader(&tar.Header{Name: "deep/er/up", Typeflag: tar.TypeSymlink, Linkname: ".."})
+	tw.Close()
+	archive := b.Bytes()
+
+	dst := t.TempDir()
+	if err := tgz.UntarWith(dst, bytes.NewReader(archive), &tgz.UntarOptions{Flatten: true}); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := ioutil.ReadDir(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		if info.IsDir() {
+			t.Fatalf("directory %s created", info.Name())
+		}
+		names = append(names, info.Name())
+	}
+	if want := []string{"a.txt", "b.txt", "c.txt", "link", "sym"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("extracted %q, want %q", names, want)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dst, "sym")); err != nil || string(data) != "c" {
+		t.Fatalf("symlink read %q, %v", data, err)
+	}
+
+	// colliding base names with RejectDuplicates
+	b.Reset()
+	tw = tar.NewWriter(b)
+	for _, name := range []string{"x/a.txt", "y/a.txt"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644})
+	}
+	tw.Close()
+	o := &tgz.UntarOptions{Flatten: true, RejectDuplicates: true}
+	if err := tgz.UntarWith(t.TempDir(), b, o); !errors.Is(err, tgz.ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate, got %v", err)
+	}
+}
+
+func TestUntarMatch(t *testing.T) {
+
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "etc", "app"), 0755)
+	for _, name := range []string{"main.conf", "etc/app/db.conf", "etc/app/data.bin", "readme.md"} {
+		ioutil.WriteFile(filepath.Join(src, filepath.FromSlash(name)), []byte(name), 0644)
+	}
+
+	b := new(bytes.Buffer)
+	if err := tgz.Tar(src, nil, b); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+
+	exists := func(dst, name string) bool {
+		_, err := os.Stat(filepath.Join(dst, filepath.FromSlash(name)))
+		return err == nil
+	}
+
+	// a base name pattern matches at any depth
+	dst := t.TempDir()
+	if err := tgz.UntarMatch(dst, "*.conf", bytes.NewReader(archive)); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(dst, "main.conf") || !exists(dst, "etc/app/db.conf") || exists(dst, "etc/app/data.bin") || exists(dst, "readme.md") {
+		t.Fatal("unexpected entries extracted for *.conf")
+	}
+
+	// a pattern with a slash matches the whole name
+	dst = t.TempDir()
+	if err := tgz.UntarMatch(dst, "etc/*/*", bytes.NewReader(archive)); err != nil {
+		t.Fatal(err)
+	}
+	if exists(dst, "main.conf") || !exists(dst, "etc/app/db.conf") || !exists(dst, "etc/app/data.bin") {
+		t.Fatal("unexpected entries extracted for etc/*/*")
+	}
+
+	if err := tgz.UntarMatch(t.TempDir(), "[", bytes.NewReader(archive)); err == nil {
+		t.Fatal("expected bad pattern error")
+	}
+}
+
+func TestTarGlob(t *testing.T) {
+
+	src := t.TempDir()
+	for _, name := range []string{"a.log", "b.log", "c.txt"} {
+		ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644)
+	}
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarGlob(filepath.Join(src, "*.log"), nil, b); err != nil {
+		t.Fatal(err)
+	}
+	files, err := tgz.UntarMap(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || string(files["a.log"]) != "a.log" || string(files["b.log"]) != "b.log" {
+		t.Fatalf("unexpected files %q", files)
+	}
+
+	// no matches is an empty archive unless entries are required
+	if err := tgz.TarGlob(filepath.Join(src, "*.gz"), nil, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	o := &tgz.TarOptions{RequireEntries: true}
+	if err := tgz.TarGlobWith(filepath.Join(src, "*.gz"), nil, o, ioutil.Discard); err != tgz.ErrEmpty {
+		t.Fatalf("expected ErrEmpty, got %v", err)
+	}
+}
+
+func TestTarFilesOptions(t *testing.T) {
+
+	dir := t.TempDir()
+	var files []string
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		file := filepath.Join(dir, name)
+		ioutil.WriteFile(file, []byte("same"), 0644)
+		files = append(files, file)
+	}
+
+	upper := func(name string, r io.Reader) (io.Reader, error) {
+		b, err := ioutil.ReadAll(r)
+		return bytes.NewReader(bytes.ToUpper(b)), err
+	}
+
+	// one walk over all files, so the archive level options span them
+	b := new(bytes.Buffer)
+	o := &tgz.TarOptions{Dedup: true, WithChecksums: true, BodyTransform: upper}
+	if err := tgz.TarFilesWith(files, nil, o, b); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+
+	headers, err := tgz.List(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 4 || headers[1].Typeflag != tar.TypeLink || headers[3].Name != "SHA256SUMS" {
+		t.Fatalf("unexpected headers %+v", headers)
+	}
+	contents, err := tgz.UntarMap(bytes.NewReader(archive))
+	if err != nil || string(contents["a.txt"]) != "SAME" {
+		t.Fatalf("unexpected map %q, %v", contents, err)
+	}
+	if n := strings.Count(string(contents["SHA256SUMS"]), "\n"); n != 3 {
+		t.Fatalf("%d checksum lines", n)
+	}
+
+	b.Reset()
+	if err := tgz.TarFilesWith(files, nil, &tgz.TarOptions{ContentAddressed: true}, b); err != nil {
+		t.Fatal(err)
+	}
+	contents, err = tgz.UntarMap(b)
+	if err != nil || len(contents) != 2 || contents["manifest.json"] == nil {
+		t.Fatalf("unexpected content addressed map %q, %v", contents, err)
+	}
+}
+
+func TestTarPAXRecords(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644)
+
+	b := new(bytes.Buffer)
+	o := &tgz.TarOptions{PAXRecords: map[string]string{"comment.commit": "bccc14d"}}
+	if err := tgz.TarWith(src, nil, o, b); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+
+	headers, err := tgz.List(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 2 || headers[0].Typeflag != tar.TypeXGlobalHeader ||
+		headers[0].PAXRecords["comment.commit"] != "bccc14d" {
+		t.Fatalf("unexpected headers %+v", headers)
+	}
+
+	// the global header is not extracted
+	dst := t.TempDir()
+	if err := tgz.Untar(dst, bytes.NewReader(archive)); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ := ioutil.ReadDir(dst); len(infos) != 1 {
+		t.Fatalf("unexpected extraction %v", infos)
+	}
+}
+
+func TestTarSkipped(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644)
+	os.Symlink("a.txt", filepath.Join(src, "link"))
+
+	var skipped []string
+	o := &tgz.TarOptions{Skipped: func(file string) { skipped = append(skipped, file) }}
+	if err := tgz.TarWith(src, nil, o, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[0] != filepath.Join(src, "link") {
+		t.Fatalf("unexpected skipped %q", skipped)
+	}
+}
+
+func TestUntarCleanupOnError(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	tw.WriteHeader(&tar.Header{Name: "app/bin/tool", Mode: 0755, Size: 4})
+	tw.Write([]byte("tool"))
+	tw.WriteHeader(&tar.Header{Name: "../escape", Mode: 0644})
+	tw.Close()
+
+	dst := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dst, "existing"), []byte("keep"), 0644)
+
+	err := tgz.UntarWith(dst, b, &tgz.UntarOptions{CleanupOnError: true})
+	if !errors.Is(err, tgz.ErrUnsafePath) {
+		t.Fatalf("expected ErrUnsafePath, got %v", err)
+	}
+
+	infos, _ := ioutil.ReadDir(dst)
+	if len(infos) != 1 || infos[0].Name() != "existing" {
+		t.Fatalf("destination not restored: %v", infos)
+	}
+}
+
+func TestWriterAdd(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "a.txt")
+	ioutil.WriteFile(file, []byte("from disk"), 0644)
+
+	b := new(bytes.Buffer)
+	w := tgz.NewWriter(b, nil)
+	if err := w.AddFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddBytes("b.txt", []byte("from memory")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := tgz.UntarMap(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(files["a.txt"]) != "from disk" || string(files["b.txt"]) != "from memory" {
+		t.Fatalf("unexpected map %q", files)
+	}
+}
+
+func TestTarSources(t *testing.T) {
+
+	sources := []tgz.Source{
+		{Name: "a.txt", Size: 6, Body: strings.NewReader("memory")},
+		{Name: "bin/run", Size: 3, Mode: 0700, Body: bytes.NewReader([]byte("#!\n"))},
+	}
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarSources(sources, nil, b); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+
+	headers, err := tgz.List(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 2 || headers[0].Mode != tgz.DefaultHeader().Mode || headers[1].Mode != 0700 {
+		t.Fatalf("unexpected headers %+v", headers)
+	}
+	files, err := tgz.UntarMap(bytes.NewReader(archive))
+	if err != nil || string(files["a.txt"]) != "memory" || string(files["bin/run"]) != "#!\n" {
+		t.Fatalf("unexpected map %q, %v", files, err)
+	}
+
+	// a body shorter than its size fails naming the source
+	short := []tgz.Source{{Name: "short.txt", Size: 10, Body: strings.NewReader("abc")}}
+	err = tgz.TarSources(short, nil, ioutil.Discard)
+	if !errors.Is(err, io.ErrUnexpectedEOF) || !strings.Contains(err.Error(), "short.txt") {
+		t.Fatalf("expected unexpected EOF, got %v", err)
+	}
+
+	// and a longer one rather than losing the rest
+	long := []tgz.Source{{Name: "long.txt", Size: 2, Body: strings.NewReader("abc")}}
+	err = tgz.TarSources(long, nil, ioutil.Discard)
+	if !errors.Is(err, tgz.ErrSize) || !strings.Contains(err.Error(), "long.txt") {
+		t.Fatalf("expected ErrSize, got %v", err)
+	}
+}
+
+func TestTarDigest(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("test file\n"), 0644)
+
+	b := new(bytes.Buffer)
+	digest, n, err := tgz.TarDigest(src, nil, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != sha256.Sum256(b.Bytes()) || n != int64(b.Len()) {
+		t.Fatal("digest or size mismatch")
+	}
+}
+
+func TestTarSigned(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("test file\n"), 0644)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := func(digest []byte) ([]byte, error) {
+		return ed25519.Sign(priv, digest), nil
+	}
+
+	b := new(bytes.Buffer)
+	signature, err := tgz.TarSigned(src, nil, signer, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(b.Bytes())
+	if !ed25519.Verify(pub, digest[:], signature) {
+		t.Fatal("signature does not verify")
+	}
+
+	// a signer error is returned
+	fail := func([]byte) ([]byte, error) { return nil, errors.New("no key") }
+	if _, err := tgz.TarSigned(src, nil, fail, ioutil.Discard); err == nil {
+		t.Fatal("expected signer error")
+	}
+}
+
+func TestTarToHashedFile(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("test file\n"), 0644)
+
+	dir := t.TempDir()
+	file, err := tgz.TarToHashedFile(dir, src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%x.tgz", sha256.Sum256(b)); filepath.Base(file) != want {
+		t.Fatalf("named %s, want %s", filepath.Base(file), want)
+	}
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 1 {
+		t.Fatalf("temporary file left behind: %v", infos)
+	}
+}
+
+func TestWalkBuffered(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	w := tgz.NewWriter(b, nil)
+	w.AddBytes("small.txt", []byte("small"))
+	w.AddBytes("large.txt", bytes.Repeat([]byte("x"), 64))
+	w.Close()
+	archive := b.Bytes()
+
+	var got []string
+	err := tgz.WalkBuffered(bytes.NewReader(archive), 64, func(header *tar.Header, body *bytes.Reader) error {
+		got = append(got, fmt.Sprintf("%s:%d", header.Name, body.Len()))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != "small.txt:5,large.txt:64" {
+		t.Fatalf("unexpected walk %q", got)
+	}
+
+	err = tgz.WalkBuffered(bytes.NewReader(archive), 32, func(*tar.Header, *bytes.Reader) error { return nil })
+	if !errors.Is(err, tgz.ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+
+	// a plain tar of eight 8KB entries, read while a slow fn holds the first
+	b.Reset()
+	tw := tar.NewWriter(b)
+	for i := 0; i < 8; i++ {
+		tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("%d.bin", i), Mode: 0644, Size: 8192})
+		tw.Write(make([]byte, 8192))
+	}
+	tw.Close()
+	archive = b.Bytes()
+
+	// up to a second to read it all, or 100ms to show the cap holds it back
+	for _, c := range []struct {
+		bufSize int
+		ahead   bool
+		wait    time.Duration
+	}{{1 << 20, true, time.Second}, {3 * (512 + 8192), false, 100 * time.Millisecond}} {
+		cr := &countingReader{r: bytes.NewReader(archive)}
+		var first int64
+		err = tgz.WalkBuffered(cr, c.bufSize, func(header *tar.Header, body *bytes.Reader) error {
+			if header.Name == "0.bin" {
+				for deadline := time.Now().Add(c.wait); cr.count() < int64(len(archive)) && time.Now().Before(deadline); {
+					time.Sleep(5 * time.Millisecond)
+				}
+				first = cr.count()
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ahead := first == int64(len(archive)); ahead != c.ahead {
+			t.Fatalf("buffer %d: %d of %d bytes read during the first entry", c.bufSize, first, len(archive))
+		}
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(&cr.n, int64(n))
+	return n, err
+}
+
+func (cr *countingReader) count() int64 { return atomic.LoadInt64(&cr.n) }
+
+func TestUntarVerifyDirs(t *testing.T) {
+
+	// a later symlink replaces the empty directory of the same name
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	tw.WriteHeader(&tar.Header{Name: "keep/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "lost/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "lost", Typeflag: tar.TypeSymlink, Linkname: "keep/none"})
+	tw.Close()
+
+	err := tgz.UntarWith(t.TempDir(), b, &tgz.UntarOptions{VerifyDirs: true})
+	if !errors.Is(err, tgz.ErrMissingDir) || !strings.Contains(err.Error(), `"lost/"`) || strings.Contains(err.Error(), "keep") {
+		t.Fatalf("expected ErrMissingDir for lost/, got %v", err)
+	}
+}
+
+func TestUntarDirTimes(t *testing.T) {
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	tw.WriteHeader(&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime})
+	tw.WriteHeader(&tar.Header{Name: "a/b/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime})
+	tw.WriteHeader(&tar.Header{Name: "a/b/c.txt", Mode: 0644, Size: 1, ModTime: mtime})
+	tw.Write([]byte("c"))
+	tw.Close()
+
+	dst := t.TempDir()
+	if err := tgz.Untar(dst, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// the children were written after their directories were created
+	for _, name := range []string{"a", "a/b"} {
+		info, err := os.Stat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Fatalf("%s: mtime %v, want %v", name, info.ModTime(), mtime)
+		}
+	}
+}
+
+func TestExtractIndex(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	w := tgz.NewWriter(b, nil)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		w.AddBytes(name, []byte("body of "+name))
+	}
+	w.Close()
+	archive := b.Bytes()
+
+	out := new(bytes.Buffer)
+	header, n, err := tgz.ExtractIndex(bytes.NewReader(archive), 1, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Name != "b.txt" || n != 13 || out.String() != "body of b.txt" {
+		t.Fatalf("unexpected entry %s %d %q", header.Name, n, out)
+	}
+
+	if _, _, err := tgz.ExtractIndex(bytes.NewReader(archive), 3, ioutil.Discard); err == nil {
+		t.Fatal("expected an error past the last entry")
+	}
+	if _, _, err := tgz.ExtractIndex(bytes.NewReader(archive), -5, ioutil.Discard); err == nil {
+		t.Fatal("expected an error for a negative index")
+	}
+}
+
+func TestVerifyManifest(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	w := tgz.NewWriter(b, nil)
+	w.AddBytes("a.txt", []byte("alpha"))
+	w.AddBytes("b.txt", []byte("bravo"))
+	w.Close()
+	archive := b.Bytes()
+
+	sum := func(s string) []byte { h := sha256.Sum256([]byte(s)); return h[:] }
+
+	want := map[string][]byte{"a.txt": sum("alpha"), "b.txt": sum("bravo")}
+	if err := tgz.VerifyManifest(bytes.NewReader(archive), want); err != nil {
+		t.Fatal(err)
+	}
+
+	want = map[string][]byte{"a.txt": sum("tampered"), "c.txt": sum("charlie")}
+	err := tgz.VerifyManifest(bytes.NewReader(archive), want)
+	if !errors.Is(err, tgz.ErrMismatch) {
+		t.Fatalf("expected ErrMismatch, got %v", err)
+	}
+	for _, s := range []string{`mismatched "a.txt"`, `missing "c.txt"`, `unexpected "b.txt"`} {
+		if !strings.Contains(err.Error(), s) {
+			t.Fatalf("%q not reported in %v", s, err)
+		}
+	}
+}
+
+func TestTarGzipHeaderReproducible(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("same input"), 0644)
+
+	mtime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	opt := &tar.Header{ModTime: mtime}
+	o := &tgz.TarOptions{GzipHeader: &gzip.Header{Name: "release.tar", ModTime: mtime, OS: 3}}
+
+	var archives [2]bytes.Buffer
+	for i := range archives {
+		if err := tgz.TarWith(src, opt, o, &archives[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(archives[0].Bytes(), archives[1].Bytes()) {
+		t.Fatal("identical input gave different archives")
+	}
+
+	h, err := tgz.GzipHeader(&archives[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Name != "release.tar" || !h.ModTime.Equal(mtime) || h.OS != 3 {
+		t.Fatalf("unexpected gzip header %+v", h)
+	}
+}
+
+func TestTarHardLinks(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("shared body"), 0644)
+	if err := os.Link(filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")); err != nil {
+		t.Skip("hard links not supported:", err)
+	}
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{HardLinks: true, Sorted: true}, b); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+
+	headers, err := tgz.List(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 2 || headers[1].Typeflag != tar.TypeLink || headers[1].Linkname != "a.txt" {
+		t.Fatalf("unexpected headers %+v", headers)
+	}
+
+	dst := t.TempDir()
+	if err := tgz.Untar(dst, bytes.NewReader(archive)); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := os.Stat(filepath.Join(dst, "a.txt"))
+	c, _ := os.Stat(filepath.Join(dst, "b.txt"))
+	if !os.SameFile(a, c) {
+		t.Fatal("hard link not restored")
+	}
+}
+
+func TestTarAccessTimes(t *testing.T) {
+
+	src := t.TempDir()
+	file := filepath.Join(src, "a.txt")
+	ioutil.WriteFile(file, []byte("a"), 0644)
+
+	atime := time.Date(2019, 5, 6, 7, 8, 9, 0, time.UTC)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(file, atime, mtime)
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{AccessTimes: true}, b); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, err := tgz.List(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers[0].AccessTime.IsZero() {
+		t.Skip("access time not reported on this platform")
+	}
+	if !headers[0].AccessTime.Equal(atime) || !headers[0].ModTime.Equal(mtime) {
+		t.Fatalf("atime %v mtime %v", headers[0].AccessTime, headers[0].ModTime)
+	}
+}
+
+func TestTarOrder(t *testing.T) {
+
+	src := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "boot.txt"} {
+		ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644)
+	}
+
+	// bootstrap first, then the rest in walk order
+	first := func(paths []string) []string {
+		ordered := []string{filepath.Join(src, "boot.txt")}
+		for _, p := range paths {
+			if filepath.Base(p) != "boot.txt" {
+				ordered = append(ordered, p)
+			}
+		}
+		return ordered
+	}
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{Order: first}, b); err != nil {
+		t.Fatal(err)
+	}
+	headers, err := tgz.List(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 3 || headers[0].Name != "boot.txt" {
+		t.Fatalf("unexpected order %+v", headers)
+	}
+}
+
+func TestTarBlockSize(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), bytes.Repeat([]byte("tape "), 1000), 0644)
+
+	var writes []int
+	rec := writerFunc(func(p []byte) (int, error) {
+		writes = append(writes, len(p))
+		return len(p), nil
+	})
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{BlockSize: 512}, b, rec); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range writes {
+		if n != 512 {
+			t.Fatalf("record of %d bytes", n)
+		}
+	}
+
+	// the padding after the archive is ignored
+	files, err := tgz.UntarMap(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files["a.txt"]) != 5000 {
+		t.Fatalf("unexpected files %q", files)
+	}
+}
+
+// writerFunc adapts a function to an io.Writer
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestFromZipReader(t *testing.T) {
+
+	zb := new(bytes.Buffer)
+	zw := zip.NewWriter(zb)
+	zw.Create("dir/")
+	w, _ := zw.Create("dir/a.txt")
+	w.Write([]byte("in memory\n"))
+	zw.Close()
+
+	zr, err := zip.NewReader(bytes.NewReader(zb.Bytes()), int64(zb.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := new(bytes.Buffer)
+	if err := tgz.FromZipReader(zr, nil, b); err != nil {
+		t.Fatal(err)
+	}
+	files, err := tgz.UntarMap(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(files["dir/a.txt"]) != "in memory\n" {
+		t.Fatalf("unexpected map %q", files)
+	}
+}
+
+func TestRegisterDecompressor(t *testing.T) {
+
+	// a made up format of a magic prefix ahead of a plain tar
+	magic := []byte("TGZTEST")
+	tgz.RegisterDecompressor(magic, func(r io.Reader) (io.ReadCloser, error) {
+		if _, err := io.CopyN(ioutil.Discard, r, int64(len(magic))); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(r), nil
+	})
+
+	b := bytes.NewBuffer(append([]byte(nil), magic...))
+	tw := tar.NewWriter(b)
+	tw.WriteHeader(&tar.Header{Name: "a.txt", Mode: 0644, Size: 6})
+	tw.Write([]byte("custom"))
+	tw.Close()
+
+	files, err := tgz.UntarMap(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(files["a.txt"]) != "custom" {
+		t.Fatalf("unexpected map %q", files)
+	}
+}
+
+func TestUntarBzip2(t *testing.T) {
+
+	// tar of a.txt compressed with bzip2 -9
+	compressed, _ := base64.StdEncoding.DecodeString("QlpoOTFBWSZTWSP0ddoAAG37gMmAAAJAAXeAAAhwIF5QCAggAFRCmmjBNMAD1BJIgZqNANAfdSIIQPYhCHrlgUeV6BDAxvSIosI2giQ69HUkpXaCnMDMNga2wfGZkXBdyRThQkCP0ddo")
+	files, err := tgz.UntarMap(bytes.NewReader(compressed))
+	if err != nil || string(files["a.txt"]) != "bzip2" {
+		t.Fatalf("unexpected map %q, %v", files, err)
+	}
+
+	// a plain tar whose first name starts with the bzip2 magic
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "BZhello.txt"), []byte("plain"), 0644)
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{Store: true}, b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tgz.List(bytes.NewReader(b.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if err := tgz.Untar(t.TempDir(), b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestToZipWriter(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	tw.WriteHeader(&tar.Header{Name: "a.txt", Mode: 0640, Size: 5})
+	tw.Write([]byte("alpha"))
+	tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "a.txt", Mode: 0777})
+	tw.Close()
+
+	zb := new(bytes.Buffer)
+	zw := zip.NewWriter(zb)
+	if err := tgz.ToZipWriter(b, zw); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+
+	zr, err := zip.NewReader(bytes.NewReader(zb.Bytes()), int64(zb.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 2 || zr.File[0].Mode().Perm() != 0640 || zr.File[1].Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("unexpected zip entries %v", zr.File)
+	}
+	rc, _ := zr.File[1].Open()
+	target, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(target) != "a.txt" {
+		t.Fatalf("symlink target %q", target)
+	}
+
+	// and back again with the symlink target
+	b.Reset()
+	if err := tgz.FromZipReader(zr, nil, b); err != nil {
+		t.Fatal(err)
+	}
+	headers, err := tgz.List(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 2 || headers[1].Typeflag != tar.TypeSymlink || headers[1].Linkname != "a.txt" {
+		t.Fatalf("unexpected tar entries %+v", headers)
+	}
+}
+
+func TestEstimateRatio(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "text.txt"), bytes.Repeat([]byte("compressible "), 10000), 0644)
+
+	ratio, err := tgz.EstimateRatio(src, 64<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ratio > 0.1 {
+		t.Fatalf("repetitive text ratio %.3f", ratio)
+	}
+
+	// random bytes do not compress
+	noise := make([]byte, 64<<10)
+	rand.Read(noise)
+	ioutil.WriteFile(filepath.Join(src, "text.txt"), noise, 0644)
+
+	if ratio, err = tgz.EstimateRatio(src, 64<<10); err != nil {
+		t.Fatal(err)
+	}
+	if ratio < 0.95 {
+		t.Fatalf("random data ratio %.3f", ratio)
+	}
+}
+
+func TestPeek(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	w := tgz.NewWriter(b, nil)
+	w.AddBytes("image.png", append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 1024)...))
+	w.AddBytes("short.txt", []byte("hi"))
+	w.Close()
+
+	var got []string
+	err := tgz.Peek(b, 8, func(header *tar.Header, head []byte) error {
+		got = append(got, header.Name+":"+http.DetectContentType(head))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != "image.png:image/png,short.txt:text/plain; charset=utf-8" {
+		t.Fatalf("unexpected peek %q", got)
+	}
+}
+
+func TestTarChunkSize(t *testing.T) {
+
+	src := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), 250)
+	ioutil.WriteFile(filepath.Join(src, "big.bin"), data, 0644)
+	ioutil.WriteFile(filepath.Join(src, "small.txt"), []byte("small"), 0644)
+
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{ChunkSize: 1000, Sorted: true}, b); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+
+	headers, err := tgz.List(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, h := range headers {
+		names = append(names, h.Name)
+	}
+	if strings.Join(names, ",") != "big.bin.parts,big.bin.part0001,big.bin.part0002,big.bin.part0003,small.txt" {
+		t.Fatalf("unexpected entries %q", names)
+	}
+
+	dst := t.TempDir()
+	if err := tgz.UntarWith(dst, bytes.NewReader(archive), &tgz.UntarOptions{Reassemble: true}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dst, "big.bin"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("reassembled %d bytes, %v", len(got), err)
+	}
+	if infos, _ := ioutil.ReadDir(dst); len(infos) != 2 {
+		t.Fatalf("parts extracted as files: %v", infos)
+	}
+}
+
+func TestTarChunkSizeLinks(t *testing.T) {
+
+	src := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), 250)
+	ioutil.WriteFile(filepath.Join(src, "big"), data, 0644)
+	ioutil.WriteFile(filepath.Join(src, "copy"), data, 0644)
+	os.Link(filepath.Join(src, "big"), filepath.Join(src, "zlink"))
+
+	// no link may point at the name of a chunked file
+	o := &tgz.TarOptions{ChunkSize: 1000, HardLinks: true, Dedup: true, Sorted: true}
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, o, b); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+
+	headers, err := tgz.List(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range headers {
+		if h.Typeflag == tar.TypeLink {
+			t.Fatalf("link entry %q to %q", h.Name, h.Linkname)
+		}
+	}
+	if err := tgz.Untar(t.TempDir(), bytes.NewReader(archive)); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if err := tgz.UntarWith(dst, bytes.NewReader(archive), &tgz.UntarOptions{Reassemble: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"big", "copy", "zlink"} {
+		if got, err := ioutil.ReadFile(filepath.Join(dst, name)); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: reassembled %d bytes, %v", name, len(got), err)
+		}
+	}
+}
+
+func TestTarUidGid(t *testing.T) {
+
+	src := t.TempDir()
+	os.Mkdir(filepath.Join(src, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "dir", "a.txt"), []byte("a"), 0644)
+
+	uid, gid := 1234, 0
+	for _, path := range []string{src, filepath.Join(src, "dir", "a.txt")} {
+		b := new(bytes.Buffer)
+		if err := tgz.TarWith(path, nil, &tgz.TarOptions{Uid: &uid, Gid: &gid, Dirs: true}, b); err != nil {
+			t.Fatal(err)
+		}
+		headers, err := tgz.List(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range headers {
+			if h.Uid != uid || h.Gid != gid {
+				t.Fatalf("%s: uid %d gid %d", h.Name, h.Uid, h.Gid)
+			}
+		}
+	}
+}
+
+// flakyWriter fails its first write when fail is set
+type flakyWriter struct {
+	bytes.Buffer
+	fail bool
+}
+
+func (fw *flakyWriter) Write(p []byte) (int, error) {
+	if fw.fail {
+		return 0, errors.New("connection reset")
+	}
+	return fw.Buffer.Write(p)
+}
+
+func (fw *flakyWriter) Close() error { return nil }
+
+func TestTarWithRetry(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("retried"), 0644)
+
+	var dests []*flakyWriter
+	newWriter := func() (io.WriteCloser, error) {
+		fw := &flakyWriter{fail: len(dests) < 2}
+		dests = append(dests, fw)
+		return fw, nil
+	}
+
+	if err := tgz.TarWithRetry(src, nil, 3, newWriter); err != nil {
+		t.Fatal(err)
+	}
+	if len(dests) != 3 {
+		t.Fatalf("%d attempts", len(dests))
+	}
+	files, err := tgz.UntarMap(&dests[2].Buffer)
+	if err != nil || string(files["a.txt"]) != "retried" {
+		t.Fatalf("unexpected map %q, %v", files, err)
+	}
+
+	// out of attempts
+	dests = nil
+	if err := tgz.TarWithRetry(src, nil, 2, newWriter); err == nil {
+		t.Fatal("expected the write error")
+	}
+
+	// no attempts still makes one, which fails here
+	dests = nil
+	if err := tgz.TarWithRetry(src, nil, 0, newWriter); err == nil || len(dests) != 1 {
+		t.Fatalf("%d attempts, %v", len(dests), err)
+	}
+}
+
+func TestUntarOffset(t *testing.T) {
+
+	header := []byte("VENDOR01")
+	b := bytes.NewBuffer(append([]byte(nil), header...))
+	tgz.File("a.txt", []byte("payload"), 0644, b)
+	framed := b.Bytes()
+
+	// both a plain reader and a seeker
+	for _, r := range []io.Reader{bytes.NewBuffer(framed), bytes.NewReader(framed)} {
+		dst := t.TempDir()
+		if err := tgz.UntarOffset(dst, r, int64(len(header))); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := ioutil.ReadFile(filepath.Join(dst, "a.txt")); string(got) != "payload" {
+			t.Fatalf("unexpected content %q", got)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "a", "b"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "top.txt"), []byte("top"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "a", "b", "deep.txt"), []byte("deep"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "a", "empty"), nil, 0644)
+
+	if err := tgz.RoundTrip(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := tgz.RoundTrip(filepath.Join(src, "top.txt")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUntarErrorContext(t *testing.T) {
+
+	b := new(bytes.Buffer)
+	tw := tar.NewWriter(b)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 600})
+		tw.Write(make([]byte, 600))
+	}
+	tw.Close()
+	archive := b.Bytes()
+
+	// a body cut short names its entry
+	err := tgz.Untar(t.TempDir(), bytes.NewReader(archive[:2048+100]))
+	if err == nil || !strings.Contains(err.Error(), `"b.txt"`) {
+		t.Fatalf("expected an error naming b.txt, got %v", err)
+	}
+
+	// a corrupt header names the entry before it
+	corrupt := append([]byte(nil), archive...)
+	copy(corrupt[1536+148:], "garbage!") // checksum field of the second header
+	err = tgz.Untar(t.TempDir(), bytes.NewReader(corrupt))
+	if err == nil || !strings.Contains(err.Error(), `after "a.txt"`) {
+		t.Fatalf("expected an error after a.txt, got %v", err)
+	}
+}
+
+func TestTreeHash(t *testing.T) {
+
+	src := t.TempDir()
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("alpha"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "b.txt"), []byte("bravo"), 0644)
+
+	// different compression, timestamps, and order
+	gz, plain := new(bytes.Buffer), new(bytes.Buffer)
+	tgz.TarWith(src, &tar.Header{ModTime: time.Unix(1, 0)}, nil, gz)
+	tgz.TarWith(src, &tar.Header{ModTime: time.Unix(2, 0)}, &tgz.TarOptions{Store: true, Order: func(p []string) []string {
+		sort.Sort(sort.Reverse(sort.StringSlice(p)))
+		return p
+	}}, plain)
+
+	h1, err := tgz.TreeHash(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := tgz.TreeHash(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h1, h2) {
+		t.Fatal("same content, different tree hash")
+	}
+
+	ioutil.WriteFile(filepath.Join(src, "b.txt"), []byte("brave"), 0644)
+	changed := new(bytes.Buffer)
+	tgz.Tar(src, nil, changed)
+	if h3, _ := tgz.TreeHash(changed); bytes.Equal(h1, h3) {
+		t.Fatal("changed content, same tree hash")
+	}
+}
+
+func TestEmptyFiles(t *testing.T) {
+
+	src := t.TempDir()
+	os.Mkdir(filepath.Join(src, "only-empty"), 0755)
+	for _, name := range []string{"empty.txt", "only-empty/a", "only-empty/b"} {
+		ioutil.WriteFile(filepath.Join(src, name), nil, 0644)
+	}
+
+	b := new(bytes.Buffer)
+	if err := tgz.Tar(src, &tar.Header{Mode: 0600}, b); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+
+	headers, err := tgz.List(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 3 {
+		t.Fatalf("unexpected headers %+v", headers)
+	}
+	for _, h := range headers {
+		if h.Size != 0 {
+			t.Fatalf("%s: size %d", h.Name, h.Size)
+		}
+	}
+
+	dst := t.TempDir()
+	if err := tgz.Untar(dst, bytes.NewReader(archive)); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range headers {
+		info, err := os.Stat(filepath.Join(dst, h.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.Mode().IsRegular() || info.Size() != 0 || info.Mode().Perm() != 0600 {
+			t.Fatalf("%s: %v %d bytes", h.Name, info.Mode(), info.Size())
+		}
+	}
+
+	// a single empty file
+	b.Reset()
+	if err := tgz.Tar(filepath.Join(src, "empty.txt"), nil, b); err != nil {
+		t.Fatal(err)
+	}
+	files, err := tgz.UntarMap(b)
+	if content, ok := files["empty.txt"]; err != nil || !ok || len(content) != 0 {
+		t.Fatalf("unexpected map %q, %v", files, err)
+	}
+}
+
+func TestTarDictionary(t *testing.T) {
+
+	src := t.TempDir()
+	for i := 0; i < 50; i++ {
+		record := fmt.Sprintf(`{"id":%d,"type":"event","source":"sensor","status":"ok","unit":"celsius"}`, i)
+		ioutil.WriteFile(filepath.Join(src, fmt.Sprintf("r%02d.json", i)), []byte(record), 0644)
+	}
+	dict := []byte(`{"id":0,"type":"event","source":"sensor","status":"ok","unit":"celsius"} r00.json ustar`)
+
+	plain := new(bytes.Buffer)
+	if err := tgz.Tar(src, nil, plain); err != nil {
+		t.Fatal(err)
+	}
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, nil, &tgz.TarOptions{Dictionary: dict}, b); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+	if len(archive) >= plain.Len() {
+		t.Fatalf("dictionary archive %d bytes, plain %d bytes", len(archive), plain.Len())
+	}
+
+	r, err := tgz.NewDictReader(bytes.NewReader(archive), dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := tgz.UntarMap(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 50 || !strings.Contains(string(files["r07.json"]), `"id":7`) {
+		t.Fatalf("unexpected map of %d files", len(files))
+	}
+
+	// another dictionary is refused up front
+	if _, err := tgz.NewDictReader(bytes.NewReader(archive), []byte("other")); !errors.Is(err, tgz.ErrDictionary) {
+		t.Fatalf("expected ErrDictionary, got %v", err)
+	}
+
+	// the stream stays at EOF once the trailer was verified
+	r, _ = tgz.NewDictReader(bytes.NewReader(archive), dict)
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("read %d bytes after EOF, %v", n, err)
+	}
+
+	// TarFiles and the Archiver write the same stream
+	paths, _ := filepath.Glob(filepath.Join(src, "*.json"))
+	o := &tgz.TarOptions{Dictionary: dict}
+	for name, write := range map[string]func(io.Writer) error{
+		"TarFiles": func(w io.Writer) error { return tgz.TarFilesWith(paths, nil, o, w) },
+		"Archiver": func(w io.Writer) error { return (&tgz.Archiver{Options: o}).Tar(src, nil, w) },
+	} {
+		b.Reset()
+		if err := write(b); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tgz.UntarMap(bytes.NewReader(b.Bytes())); err == nil {
+			t.Fatalf("%s: read without the dictionary", name)
+		}
+		r, err := tgz.NewDictReader(b, dict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files, err := tgz.UntarMap(r); err != nil || len(files) != 50 {
+			t.Fatalf("%s: %d files, %v", name, len(files), err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package tgz_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/zxdez/tgz"
+)
+
+func TestTarPreserveTimes(t *testing.T) {
+
+	src := t.TempDir()
+	file := filepath.Join(src, "a.txt")
+	ioutil.WriteFile(file, []byte("a"), 0644)
+
+	atime := time.Date(2019, 5, 6, 7, 8, 9, 0, time.UTC)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(file, atime, mtime)
+
+	// the times of opt are ignored
+	opt := &tar.Header{Mode: 0644, ModTime: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b := new(bytes.Buffer)
+	if err := tgz.TarWith(src, opt, &tgz.TarOptions{PreserveTimes: true}, b); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+
+	headers, err := tgz.List(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers[0].AccessTime.IsZero() {
+		t.Skip("access time not reported on this platform")
+	}
+	if !headers[0].AccessTime.Equal(atime) || !headers[0].ModTime.Equal(mtime) || headers[0].ChangeTime.IsZero() {
+		t.Fatalf("atime %v mtime %v ctime %v", headers[0].AccessTime, headers[0].ModTime, headers[0].ChangeTime)
+	}
+
+	dst := t.TempDir()
+	if err := tgz.Untar(dst, bytes.NewReader(archive)); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dst, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Fatalf("mtime %v", info.ModTime())
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	if got := time.Unix(st.Atim.Unix()); !got.Equal(atime) {
+		t.Fatalf("atime %v", got)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build aix || darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd illumos linux netbsd openbsd solaris
+
+package tgz
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+var (
+	umaskOnce sync.Once
+	umaskBits os.FileMode
+)
+
+// umask returns the file mode creation mask of the process, read once as
+// it can only be read by setting it
+func umask() os.FileMode {
+
+	umaskOnce.Do(func() {
+		mask := syscall.Umask(0)
+		syscall.Umask(mask)
+		umaskBits = os.FileMode(mask)
+	})
+
+	return umaskBits
+}
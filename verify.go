@@ -0,0 +1,77 @@
+package tgz
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrMismatch is returned by VerifyManifest when the archive does not match
+// the expected hashes
+var ErrMismatch = errors.New("tgz: archive does not match manifest")
+
+// VerifyManifest takes an io.Reader of a tar.gz or plain tar stream and
+// compares the sha256 of each regular file body against want, keyed by entry
+// name, without extracting anything. Any mismatched, missing, or unexpected
+// entries are named in the returned ErrMismatch.
+func VerifyManifest(r io.Reader, want map[string][]byte) error {
+
+	var mismatched, unexpected []string
+	seen := make(map[string]bool)
+
+	err := Walk(r, func(header *tar.Header, body io.Reader) error {
+
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		seen[header.Name] = true
+
+		sum, ok := want[header.Name]
+		if !ok {
+			unexpected = append(unexpected, strconv.Quote(header.Name))
+			return nil
+		}
+
+		h := sha256.New()
+		if _, err := io.Copy(h, body); err != nil {
+			return err
+		}
+		if !bytes.Equal(h.Sum(nil), sum) {
+			mismatched = append(mismatched, strconv.Quote(header.Name))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for name := range want {
+		if !seen[name] {
+			missing = append(missing, strconv.Quote(name))
+		}
+	}
+	sort.Strings(missing)
+
+	var problems []string
+	for _, p := range []struct {
+		what  string
+		names []string
+	}{{"mismatched", mismatched}, {"missing", missing}, {"unexpected", unexpected}} {
+		if len(p.names) > 0 {
+			problems = append(problems, p.what+" "+strings.Join(p.names, ", "))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrMismatch, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,271 @@
+package tgz
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+)
+
+// errStop ends a Walk early once the wanted entry was handled
+var errStop = errors.New("tgz: stop walk")
+
+// Walk takes an io.Reader of a tar.gz or plain tar stream and calls fn with
+// the header and body reader of each entry in order until the end of the
+// archive or fn returns an error. Any body fn leaves unread is skipped, by
+// seeking past it when r is an io.ReadSeeker over a plain tar and by reading
+// and discarding it otherwise.
+func Walk(r io.Reader, fn func(header *tar.Header, body io.Reader) error) error {
+
+	ar, err := openArchive(r)
+	if err != nil {
+		return err
+	}
+	defer ar.Close()
+
+	tr := tar.NewReader(ar)
+
+	for {
+
+		header, err := tr.Next()
+		switch {
+		case err == io.EOF:
+			return nil
+
+		case err != nil:
+			return err
+		}
+
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// WalkBuffered is Walk with each body read whole into memory by a goroutine
+// that runs ahead of fn, so the archive is read while a slow consumer works.
+// The bodies read ahead but not yet handled by fn, each counted with its 512
+// byte header block, are held to bufSize bytes in all, although a single
+// entry is always read when nothing else is held. An entry larger than
+// bufSize returns ErrTooLarge once the entries before it were handled. The
+// body is only valid until fn returns.
+func WalkBuffered(r io.Reader, bufSize int, fn func(header *tar.Header, body *bytes.Reader) error) error {
+
+	rb := &readAhead{limit: int64(bufSize)}
+	rb.cond = sync.NewCond(&rb.mu)
+	go rb.read(r)
+	defer rb.stop()
+
+	for {
+		entry, err := rb.next()
+		if err != nil || entry == nil {
+			return err
+		}
+		if err := fn(entry.header, bytes.NewReader(entry.body)); err != nil {
+			return err
+		}
+		rb.release(entry)
+	}
+}
+
+// readAhead is the queue of bodies WalkBuffered reads ahead of its consumer
+type readAhead struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    int64
+	held     int64 // bytes read ahead and not yet released
+	queue    []*bufferedEntry
+	stopped  bool  // set by the consumer to end the read early
+	finished bool  // set once the reader goroutine exits
+	err      error // of the reader, returned once the queue drains
+}
+
+// headerBlock is the size of a tar header, counted for each entry read ahead
+const headerBlock = 512
+
+// bufferedEntry is a header and the whole body read ahead for it
+type bufferedEntry struct {
+	header *tar.Header
+	body   []byte
+	cost   int64
+}
+
+// read walks r, queuing each entry once the held bytes leave room for it
+func (rb *readAhead) read(r io.Reader) {
+
+	err := Walk(r, func(header *tar.Header, body io.Reader) error {
+
+		if header.Size > rb.limit {
+			return fmt.Errorf("%w: %q declares %d bytes, buffer %d", ErrTooLarge, header.Name, header.Size, rb.limit)
+		}
+
+		cost := headerBlock + header.Size
+		rb.mu.Lock()
+		for !rb.stopped && rb.held > 0 && rb.held+cost > rb.limit {
+			rb.cond.Wait()
+		}
+		stopped := rb.stopped
+		if !stopped {
+			rb.held += cost
+		}
+		rb.mu.Unlock()
+		if stopped {
+			return errStop
+		}
+
+		data := make([]byte, header.Size)
+		if _, err := io.ReadFull(body, data); err != nil {
+			return err
+		}
+
+		rb.mu.Lock()
+		rb.queue = append(rb.queue, &bufferedEntry{header: header, body: data, cost: cost})
+		rb.cond.Broadcast()
+		rb.mu.Unlock()
+
+		return nil
+	})
+
+	rb.mu.Lock()
+	rb.finished, rb.err = true, err
+	rb.cond.Broadcast()
+	rb.mu.Unlock()
+}
+
+// next returns the next queued entry, or nil and the error of the reader
+// once the archive is exhausted
+func (rb *readAhead) next() (*bufferedEntry, error) {
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	for len(rb.queue) == 0 && !rb.finished {
+		rb.cond.Wait()
+	}
+	if len(rb.queue) == 0 {
+		return nil, rb.err
+	}
+
+	entry := rb.queue[0]
+	rb.queue = rb.queue[1:]
+
+	return entry, nil
+}
+
+// release returns the bytes of a handled entry to the reader
+func (rb *readAhead) release(entry *bufferedEntry) {
+
+	rb.mu.Lock()
+	rb.held -= entry.cost
+	rb.cond.Broadcast()
+	rb.mu.Unlock()
+}
+
+// stop ends the reader goroutine and waits for it, so r is no longer read
+// once WalkBuffered returns
+func (rb *readAhead) stop() {
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.stopped = true
+	rb.cond.Broadcast()
+	for !rb.finished {
+		rb.cond.Wait()
+	}
+}
+
+// Peek takes an io.Reader of a tar.gz or plain tar stream and calls fn with
+// the header and up to the first n bytes of the body of each entry, such as
+// to sniff content types, skipping the rest of each body as Walk does. The
+// head slice is reused, so it is only valid until fn returns.
+func Peek(r io.Reader, n int, fn func(header *tar.Header, head []byte) error) error {
+
+	buf := make([]byte, n)
+	return Walk(r, func(header *tar.Header, body io.Reader) error {
+		m, err := io.ReadFull(body, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		return fn(header, buf[:m])
+	})
+}
+
+// ExtractIndex takes an io.Reader of a tar.gz or plain tar stream and copies
+// the body of the entry at the 0-based index, as ordered by List, to w and
+// returns its header and the bytes copied. The bodies of the entries before
+// it are skipped.
+func ExtractIndex(r io.Reader, index int, w io.Writer) (tar.Header, int64, error) {
+
+	if index < 0 {
+		return tar.Header{}, 0, fmt.Errorf("tgz: negative entry index %d", index)
+	}
+
+	var header tar.Header
+	var n int64
+	i := 0
+	err := Walk(r, func(h *tar.Header, body io.Reader) error {
+		if i++; i <= index {
+			return nil
+		}
+		header = *h
+		var err error
+		if n, err = io.Copy(w, body); err != nil {
+			return err
+		}
+		return errStop
+	})
+	switch {
+	case err == errStop:
+		return header, n, nil
+	case err != nil:
+		return header, n, err
+	}
+
+	return header, 0, fmt.Errorf("tgz: no entry at index %d of %d", index, i)
+}
+
+// List takes an io.Reader of a tar.gz or plain tar stream and returns the
+// header of every entry without reading the bodies
+func List(r io.Reader) ([]*tar.Header, error) {
+
+	var headers []*tar.Header
+	err := Walk(r, func(header *tar.Header, body io.Reader) error {
+		headers = append(headers, header)
+		return nil
+	})
+
+	return headers, err
+}
+
+// ListTop takes an io.Reader of a tar.gz or plain tar stream and returns
+// the unique first path components of the entries, the files and
+// directories directly under the root, in the order they first appear
+func ListTop(r io.Reader) ([]string, error) {
+
+	var names []string
+	seen := make(map[string]bool)
+	err := Walk(r, func(header *tar.Header, body io.Reader) error {
+
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			return nil
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			name = name[:i]
+		}
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+
+		return nil
+	})
+
+	return names, err
+}
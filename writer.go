@@ -0,0 +1,228 @@
+package tgz
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// Writer is a tar.gz archive that stays open so entries can be added to it
+// over time; Close must be called to finish the archive
+type Writer struct {
+	tw     *tar.Writer
+	opt    *tar.Header
+	o      *TarOptions
+	finish func() error    // closes the output layers
+	dirs   map[string]bool // parent entries written for DirsFirst
+}
+
+// NewWriter returns a Writer for the archive written to w. Pass opt as nil
+// to use defaults, opt will accept custom Gname, Uname, Mode, and ModTime
+// applied to every entry that does not bring its own.
+func NewWriter(w io.Writer, opt *tar.Header) *Writer {
+	tw, _ := NewWriterWith(w, opt, nil) // plain gzip can not fail
+	return tw
+}
+
+// NewWriterWith is NewWriter with the extended settings in o applied, of
+// which only BlockSize, Store, Dictionary, GzipHeader, and DirsFirst apply
+// to entries added one at a time; pass o as nil to use the defaults
+func NewWriterWith(w io.Writer, opt *tar.Header, o *TarOptions) (*Writer, error) {
+
+	// apply default options when nil or empty
+	opt = ApplyDefaults(opt)
+	if o == nil {
+		o = &TarOptions{}
+	}
+
+	w, finish, err := o.layers(w, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{tw: tar.NewWriter(w), opt: opt, o: o, finish: finish, dirs: make(map[string]bool)}, nil
+}
+
+// parents writes an entry for each directory above name not yet in the
+// archive when DirsFirst is set
+func (w *Writer) parents(name string) error {
+
+	if !w.o.DirsFirst {
+		return nil
+	}
+
+	opt := *w.opt
+	if opt.ModTime.IsZero() {
+		opt.ModTime = time.Now().UTC().Round(time.Second)
+	}
+
+	for _, dir := range newParents(w.dirs, path.Clean(name)) {
+		if err := w.tw.WriteHeader(w.o.archiveDir(dir, &opt)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Source is one entry for TarSources, with a body that need not be a file
+type Source struct {
+	Name string    // entry name
+	Size int64     // exact number of bytes Body yields
+	Mode int64     // permissions; zero uses opt.Mode
+	Body io.Reader // entry content
+}
+
+// TarSources writes each of sources as a file entry in order, for archives
+// assembled from in-memory and streaming content rather than a directory.
+// Pass opt as nil to use defaults, opt will accept custom Gname, Uname,
+// Mode, and ModTime for every entry; without a ModTime the entries are
+// stamped with the current time.
+func TarSources(sources []Source, opt *tar.Header, w ...io.Writer) error {
+	return TarSourcesWith(sources, opt, nil, w...)
+}
+
+// TarSourcesWith is TarSources with the extended settings in o applied, as
+// for NewWriterWith; pass o as nil to use the defaults
+func TarSourcesWith(sources []Source, opt *tar.Header, o *TarOptions, w ...io.Writer) error {
+
+	tw, err := NewWriterWith(io.MultiWriter(w...), opt, o)
+	if err != nil {
+		return err
+	}
+	if tw.opt.ModTime.IsZero() {
+		tw.opt.ModTime = time.Now().UTC().Round(time.Second)
+	}
+
+	for _, src := range sources {
+		if err := tw.addSource(src); err != nil {
+			tw.Close()
+			return fmt.Errorf("tgz: source %q: %w", src.Name, err)
+		}
+	}
+
+	return tw.Close()
+}
+
+// addSource writes the body of src as an entry of exactly src.Size bytes
+func (w *Writer) addSource(src Source) error {
+
+	header := &tar.Header{
+		Name:    src.Name,
+		Size:    src.Size,
+		Uname:   w.opt.Uname,
+		Gname:   w.opt.Gname,
+		Mode:    src.Mode,
+		ModTime: w.opt.ModTime,
+	}
+	if header.Mode == 0 {
+		header.Mode = w.opt.Mode
+	}
+
+	if err := w.parents(header.Name); err != nil {
+		return err
+	}
+	if err := w.tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	// a body shorter than its declared size fails
+	if _, err := io.CopyN(w.tw, src.Body, src.Size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	// as does a longer one, rather than silently dropping the rest
+	if n, _ := io.ReadFull(src.Body, make([]byte, 1)); n > 0 {
+		return fmt.Errorf("%w: body longer than %d bytes", ErrSize, src.Size)
+	}
+
+	return nil
+}
+
+// Close finishes the archive; the underlying io.Writer is not closed
+func (w *Writer) Close() error {
+
+	err := w.tw.Close()
+	if cerr := w.finish(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// AddFile writes the regular file at path to the archive under its base
+// name with the Writer defaults
+func (w *Writer) AddFile(path string) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return AddFile(w, f, "", nil)
+}
+
+// AddBytes writes data to the archive as a file entry called name with the
+// Writer defaults, stamped with the current time when no ModTime is set
+func (w *Writer) AddBytes(name string, data []byte) error {
+
+	opt := *w.opt
+	if opt.ModTime.IsZero() {
+		opt.ModTime = time.Now().UTC().Round(time.Second)
+	}
+
+	if err := w.parents(name); err != nil {
+		return err
+	}
+
+	return writeEntry(w.tw, &opt, name, data)
+}
+
+// AddFile writes the already open file f to the archive as name, using the
+// open handle for both the stat and the copy so the file is never reopened
+// by path. Pass name as empty to use the base name of f, and opt as nil to
+// use the Writer defaults.
+func AddFile(w *Writer, f *os.File, name string, opt *tar.Header) error {
+
+	if opt == nil {
+		opt = w.opt
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New("tgz: " + f.Name() + " is not a regular file")
+	}
+
+	// create a new file header for the archive
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	setHeader(header, opt)
+
+	header.Name = name
+	if name == "" {
+		header.Name = filepath.Base(f.Name())
+	}
+
+	if err := w.parents(header.Name); err != nil {
+		return err
+	}
+	if err := w.tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	return copyBody(w.tw, f, f.Name(), header.Size)
+}
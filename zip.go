@@ -0,0 +1,160 @@
+package tgz
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// FromZip takes a zip archive path and writes each of its entries into a
+// tar.gz stream on dst. Pass opt as nil to use defaults, opt will accept a
+// custom Gname and Uname; file modes and modification times are carried
+// over from the zip entries, and a symlink takes its target from its body
+// as Info-ZIP and ToZipWriter store it.
+func FromZip(dst io.Writer, zipPath string, opt *tar.Header) error {
+
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	return FromZipReader(&zr.Reader, opt, dst)
+}
+
+// FromZipReader is FromZip for an already open zip archive, such as one read
+// from memory with zip.NewReader, writing the tar.gz stream to every writer
+// in w
+func FromZipReader(zr *zip.Reader, opt *tar.Header, w ...io.Writer) error {
+
+	// apply default options when nil or empty
+	opt = ApplyDefaults(opt)
+
+	gzw := gzip.NewWriter(io.MultiWriter(w...)) // compression
+	tw := tar.NewWriter(gzw)                    // tarball
+
+	err := fromZip(tw, zr, opt)
+	if cerr := tw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := gzw.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// fromZip writes each entry of zr into tw
+func fromZip(tw *tar.Writer, zr *zip.Reader, opt *tar.Header) error {
+
+	for _, zf := range zr.File {
+
+		// create a new file header from the zip entry
+		header, err := tar.FileInfoHeader(zf.FileInfo(), "")
+		if err != nil {
+			return err
+		}
+
+		header.Name = zf.Name
+		header.Gname = opt.Gname // set group
+		header.Uname = opt.Uname // set user
+
+		// zip files from some tools carry no permissions at all
+		if header.Mode&0777 == 0 {
+			header.Mode |= opt.Mode
+		}
+
+		// a symlink stores its target as the body, as Info-ZIP writes it
+		if header.Typeflag == tar.TypeSymlink {
+			rc, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			target, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			header.Linkname = string(target)
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ToZip takes an io.Reader of a tar.gz stream and writes each regular file,
+// directory, and symlink entry into a zip archive on dst, as ToZipWriter
+// does
+func ToZip(dst io.Writer, src io.Reader) error {
+
+	zw := zip.NewWriter(dst)
+	if err := ToZipWriter(src, zw); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// ToZipWriter takes an io.Reader of a tar.gz stream and writes each regular
+// file, directory, and symlink entry into zw, carrying over the names, modes,
+// and modification times; a symlink is stored the way Info-ZIP stores it,
+// with the target as its body. Other entry types have no zip equivalent and
+// are skipped. zw is left open for the caller to add to or close.
+func ToZipWriter(r io.Reader, zw *zip.Writer) error {
+
+	return Walk(r, func(header *tar.Header, body io.Reader) error {
+
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeDir:
+		case tar.TypeSymlink:
+			body = strings.NewReader(header.Linkname)
+		default:
+			return nil
+		}
+
+		fh, err := zip.FileInfoHeader(header.FileInfo())
+		if err != nil {
+			return err
+		}
+
+		fh.Name = header.Name
+		switch header.Typeflag {
+		case tar.TypeDir:
+			fh.Name = strings.TrimSuffix(fh.Name, "/") + "/"
+			fh.Method = zip.Store
+		case tar.TypeSymlink:
+			fh.Method = zip.Store
+		default:
+			fh.Method = zip.Deflate
+		}
+
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, body)
+
+		return err
+	})
+}